@@ -0,0 +1,665 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"log"
+	"os"
+	"os/signal"
+	"ser163.cn/earthworm/config"
+	"ser163.cn/earthworm/dao"
+	"ser163.cn/earthworm/utils"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// command 一个子命令
+type command struct {
+	usage string // 参数说明
+	help  string // 命令说明
+	run   func(args []string) error
+}
+
+// commands 全部子命令
+var commands = map[string]command{
+	"run":      {"[--job name]", "同步一次, 开启 binlog 或事件时持续运行", runCommand},
+	"dry-run":  {"[--job name]", "输出将要发送到多维表格的请求, 不发送也不修改本地记录", dryRunCommand},
+	"status":   {"[--job name]", "查看同步进度、待同步数据条数和最近一次同步的结果", statusCommand},
+	"backfill": {"[--job name] --from-id id --to-id id", "重新同步主键在范围内的数据, 不改变同步进度", backfillCommand},
+	"reset":    {"[--job name] --to-id id", "将自增主键模式的同步进度设置为 id", resetCommand},
+	"daemon":   {"[--job name]", "常驻运行, 按各任务的 schedule 定时同步", daemonCommand},
+	"dlq":      {"list|retry|drop [--job name] [--id id]... [--all]", "查看、重试或丢弃无法同步而被跳过的数据", dlqCommand},
+}
+
+// usage 输出全部子命令的说明
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n            %s\n", name, commands[name].usage, commands[name].help)
+	}
+}
+
+// newFlagSet 创建子命令的参数, 所有子命令都支持 --job
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	jobName := flags.String("job", "", "任务名, 默认为全部任务")
+	return flags, jobName
+}
+
+// selectJobs 返回 --job 指定的任务配置, 未指定时返回全部任务
+func selectJobs(conf *config.Config, name string) ([]*config.Config, error) {
+	if name == "" {
+		return conf.JobConfigs(), nil
+	}
+	jobConfig, err := conf.JobConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	return []*config.Config{jobConfig}, nil
+}
+
+// selectJob 返回 --job 指定的一个任务配置, 配置了多个任务时必须指定
+func selectJob(conf *config.Config, name string) (*config.Config, error) {
+	if name == "" && len(conf.JobConfigs()) > 1 {
+		return nil, errors.New("--job is required when multiple jobs are configured")
+	}
+	jobConfigs, err := selectJobs(conf, name)
+	if err != nil {
+		return nil, err
+	}
+	return jobConfigs[0], nil
+}
+
+// openJobs 为每个任务连接源数据库并创建客户端, 连接配置相同的任务共用一个连接池, 出错时关闭已打开的连接
+func openJobs(jobConfigs []*config.Config, sqlLitedb *sql.DB) ([]*job, error) {
+	var jobs []*job
+	sources := make(map[string]*sql.DB)
+	for _, jobConfig := range jobConfigs {
+		// 从文件读取时不需要连接
+		var sourceDb *sql.DB
+		if jobConfig.Read.File.Path == "" {
+			source := jobConfig.Read
+			key := fmt.Sprintf("%s|%s|%+v|%+v", source.Driver, source.Dsn, source.Mysql, source.Postgres)
+			if sourceDb = sources[key]; sourceDb == nil {
+				var err error
+				if sourceDb, err = dao.ConnectSourceDatabase(jobConfig); err != nil {
+					closeJobs(jobs)
+					return nil, err
+				}
+				sources[key] = sourceDb
+			}
+		}
+		jobs = append(jobs, newJob(jobConfig, sqlLitedb, sourceDb))
+	}
+	return jobs, nil
+}
+
+// closeJobs 关闭各任务的源数据库连接
+func closeJobs(jobs []*job) {
+	for _, j := range jobs {
+		if j.sourceDb != nil {
+			j.sourceDb.Close()
+		}
+	}
+}
+
+// jobLabel 日志中的任务名, 未配置 jobs 时为 default
+func jobLabel(conf *config.Config) string {
+	if conf.Job == "" {
+		return "default"
+	}
+	return conf.Job
+}
+
+// runCommand 依次同步各任务, 之后接收飞书事件、读取 binlog, 任何一个出错时返回
+func runCommand(args []string) error {
+	flags, jobName := newFlagSet("run")
+	flags.Parse(args)
+
+	conf := config.GetConfig()
+	jobConfigs, err := selectJobs(conf, *jobName)
+	if err != nil {
+		return err
+	}
+	sqlLitedb, err := dao.ConnectDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer sqlLitedb.Close()
+
+	jobs, err := openJobs(jobConfigs, sqlLitedb)
+	if err != nil {
+		return err
+	}
+	defer closeJobs(jobs)
+
+	for _, j := range jobs {
+		log.Printf("running job %s", jobLabel(j.conf))
+		if err := j.run(); err != nil {
+			return fmt.Errorf("job %s: %v", jobLabel(j.conf), err)
+		}
+	}
+
+	// 接收飞书事件和读取 binlog 都会持续运行, 任何一个出错时退出
+	errs := make(chan error)
+	if startServices(conf, jobs, sqlLitedb, errs) > 0 {
+		return <-errs
+	}
+	return nil
+}
+
+// startServices 在后台接收飞书事件、读取开启了 binlog 的任务的 binlog, 出错时将错误发送到 errs, 返回启动的服务数
+func startServices(conf *config.Config, jobs []*job, sqlLitedb *sql.DB, errs chan<- error) int {
+	running := 0
+
+	// 接收飞书事件, 实时将多维表格的修改写回源数据库; 只在运行的任务中有开启写回的任务时启动
+	pulling := false
+	for _, j := range jobs {
+		pulling = pulling || j.conf.Sync.Pull.Enabled
+	}
+	if conf.FeiShu.Event.Enabled && pulling {
+		running++
+		go func() {
+			errs <- fmt.Errorf("serving events: %v", serveEvents(conf, jobs, sqlLitedb))
+		}()
+	}
+
+	// 持续读取 binlog, 实时同步之后的变更
+	for _, j := range jobs {
+		if !j.conf.Read.Binlog.Enabled {
+			continue
+		}
+		running++
+		go func(j *job) {
+			errs <- fmt.Errorf("streaming binlog of job %s: %v", jobLabel(j.conf), j.stream())
+		}(j)
+	}
+	return running
+}
+
+// daemonCommand 常驻运行, 按各任务的 schedule 定时同步, 共用数据库连接和飞书客户端.
+// 启动时先同步一次; 任务上一次运行尚未结束时跳过本次; 开启 binlog 的任务同步一次后持续读取 binlog, 不按时间运行
+func daemonCommand(args []string) error {
+	flags, jobName := newFlagSet("daemon")
+	flags.Parse(args)
+
+	conf := config.GetConfig()
+	jobConfigs, err := selectJobs(conf, *jobName)
+	if err != nil {
+		return err
+	}
+	sqlLitedb, err := dao.ConnectDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer sqlLitedb.Close()
+
+	jobs, err := openJobs(jobConfigs, sqlLitedb)
+	if err != nil {
+		return err
+	}
+	defer closeJobs(jobs)
+
+	scheduler := cron.New()
+	var scheduled []*job
+	for _, j := range jobs {
+		if j.conf.Read.Binlog.Enabled {
+			log.Printf("running job %s", jobLabel(j.conf))
+			if err := j.run(); err != nil {
+				return fmt.Errorf("job %s: %v", jobLabel(j.conf), err)
+			}
+			continue
+		}
+		spec := j.conf.Schedule.Spec()
+		if spec == "" {
+			return fmt.Errorf("job %s: schedule.cron or schedule.interval is required in daemon mode", jobLabel(j.conf))
+		}
+		if _, err := scheduler.AddFunc(spec, j.tryRun); err != nil {
+			return fmt.Errorf("job %s: %v", jobLabel(j.conf), err)
+		}
+		log.Printf("job %s scheduled: %s", jobLabel(j.conf), spec)
+		scheduled = append(scheduled, j)
+	}
+	scheduler.Start()
+	for _, j := range scheduled {
+		go j.tryRun()
+	}
+
+	errs := make(chan error)
+	startServices(conf, jobs, sqlLitedb, errs)
+
+	// 收到退出信号时等待正在运行的任务结束
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errs:
+	case sig := <-signals:
+		log.Printf("received %s, waiting for running jobs", sig)
+	}
+	<-scheduler.Stop().Done()
+	for _, j := range scheduled {
+		j.running.Lock()
+	}
+	return err
+}
+
+// dryRunCommand 在本地数据库的临时副本上同步各任务, 只输出新建、更新和删除记录的请求内容.
+// 不写回源数据库, 不接收事件也不读取 binlog
+func dryRunCommand(args []string) error {
+	flags, jobName := newFlagSet("dry-run")
+	flags.Parse(args)
+
+	conf := config.GetConfig()
+	jobConfigs, err := selectJobs(conf, *jobName)
+	if err != nil {
+		return err
+	}
+	sqlLitedb, err := dao.ConnectDatabase(conf)
+	if err != nil {
+		return err
+	}
+	copyDb, path, err := dao.CopyDatabase(sqlLitedb, conf.Database.Driver)
+	sqlLitedb.Close()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer copyDb.Close()
+
+	jobs, err := openJobs(jobConfigs, copyDb)
+	if err != nil {
+		return err
+	}
+	defer closeJobs(jobs)
+
+	for _, j := range jobs {
+		log.Printf("dry run job %s", jobLabel(j.conf))
+		j.feishuClient.DryRun = true
+		if err := j.sync(nil); err != nil {
+			return fmt.Errorf("job %s: %v", jobLabel(j.conf), err)
+		}
+	}
+	return nil
+}
+
+// statusCommand 输出各任务的同步进度、待同步数据条数和最近一次同步的结果
+func statusCommand(args []string) error {
+	flags, jobName := newFlagSet("status")
+	flags.Parse(args)
+
+	conf := config.GetConfig()
+	jobConfigs, err := selectJobs(conf, *jobName)
+	if err != nil {
+		return err
+	}
+	sqlLitedb, err := dao.ConnectDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer sqlLitedb.Close()
+
+	jobs, err := openJobs(jobConfigs, sqlLitedb)
+	if err != nil {
+		return err
+	}
+	defer closeJobs(jobs)
+
+	for _, j := range jobs {
+		watermark, err := j.readClient.Watermark()
+		if err != nil {
+			return fmt.Errorf("job %s: %v", jobLabel(j.conf), err)
+		}
+		pending := "unknown"
+		count, known, err := j.readClient.Pending()
+		if err != nil {
+			return fmt.Errorf("job %s: %v", jobLabel(j.conf), err)
+		}
+		if known {
+			pending = fmt.Sprint(count)
+		}
+		lastRun := "never"
+		result, err := dao.GetRunResult(sqlLitedb, j.conf.StateKey(runResultKey))
+		if err != nil {
+			return fmt.Errorf("job %s: %v", jobLabel(j.conf), err)
+		}
+		if result != nil {
+			lastRun = fmt.Sprintf("%s, took %s, ", result.StartedAt.Format("2006-01-02 15:04:05"), result.FinishedAt.Sub(result.StartedAt).Round(time.Millisecond))
+			if result.Error == "" {
+				lastRun += "ok"
+			} else {
+				lastRun += "failed: " + result.Error
+			}
+		}
+
+		fmt.Printf("job %s: %s -> %s/%s\n", jobLabel(j.conf), j.conf.Read.Source.Table, j.conf.FeiShu.Drive.BaseId, j.conf.FeiShu.Drive.TableId)
+		fmt.Printf("  watermark: %s\n", watermark)
+		fmt.Printf("  pending:   %s\n", pending)
+		fmt.Printf("  last run:  %s\n", lastRun)
+
+		letters, err := dao.ListDeadLetters(sqlLitedb, j.conf.Job)
+		if err != nil {
+			return fmt.Errorf("job %s: %v", jobLabel(j.conf), err)
+		}
+		fmt.Printf("  skipped:   %d\n", len(letters))
+	}
+	return nil
+}
+
+// backfillCommand 重新同步一个任务中主键在 [--from-id, --to-id] 范围内的数据:
+// 没有对应记录的新建, 内容变化的更新, 不改变同步进度
+func backfillCommand(args []string) error {
+	flags, jobName := newFlagSet("backfill")
+	fromId := flags.String("from-id", "", "起始主键, 包含在范围内")
+	toId := flags.String("to-id", "", "结束主键, 包含在范围内")
+	flags.Parse(args)
+	if *fromId == "" || *toId == "" {
+		return errors.New("--from-id and --to-id are required")
+	}
+
+	conf := config.GetConfig()
+	jobConfig, err := selectJob(conf, *jobName)
+	if err != nil {
+		return err
+	}
+	sqlLitedb, err := dao.ConnectDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer sqlLitedb.Close()
+
+	jobs, err := openJobs([]*config.Config{jobConfig}, sqlLitedb)
+	if err != nil {
+		return err
+	}
+	defer closeJobs(jobs)
+	j := jobs[0]
+	lock, err := j.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	defer j.readClient.EndRun()
+
+	if err := checkSchema(j.feishuClient); err != nil {
+		return fmt.Errorf("checking table schema: %v", err)
+	}
+	for {
+		if err := lock.check(); err != nil {
+			return err
+		}
+		records, err := j.readClient.Backfill(*fromId, *toId)
+		if err != nil {
+			return err
+		}
+		if j.readClient.Done() {
+			return nil
+		}
+		if err := syncPage(j.feishuClient, j.readClient, sqlLitedb, records); err != nil {
+			return err
+		}
+	}
+}
+
+// resetCommand 将一个任务自增主键模式的同步进度设置为 --to-id, 之后从 --to-id 之后的数据开始同步
+func resetCommand(args []string) error {
+	flags, jobName := newFlagSet("reset")
+	toId := flags.Int64("to-id", -1, "新的同步进度, 即最后一条已同步数据的主键")
+	flags.Parse(args)
+	if *toId < 0 {
+		return errors.New("--to-id is required")
+	}
+
+	conf := config.GetConfig()
+	jobConfig, err := selectJob(conf, *jobName)
+	if err != nil {
+		return err
+	}
+	sqlLitedb, err := dao.ConnectDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer sqlLitedb.Close()
+
+	jobs, err := openJobs([]*config.Config{jobConfig}, sqlLitedb)
+	if err != nil {
+		return err
+	}
+	defer closeJobs(jobs)
+	j := jobs[0]
+	lock, err := j.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	previous, err := j.readClient.Reset(*toId)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("job %s: watermark reset from id %d to id %d\n", jobLabel(j.conf), previous, *toId)
+	return nil
+}
+
+// idList 可以重复指定的 --id 参数
+type idList []int64
+
+func (l *idList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *idList) Set(value string) error {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid id %q", value)
+	}
+	*l = append(*l, id)
+	return nil
+}
+
+// dlqCommand 管理无法同步而被跳过的数据: list 列出, retry 重新同步, drop 删除
+func dlqCommand(args []string) error {
+	if len(args) == 0 || !utils.Contains([]string{"list", "retry", "drop"}, args[0]) {
+		return errors.New("usage: dlq list|retry|drop [--job name] [--id id]... [--all]")
+	}
+	action := args[0]
+	flags, jobName := newFlagSet("dlq " + action)
+	var ids idList
+	flags.Var(&ids, "id", "只处理指定编号的数据, 可以重复指定")
+	all := flags.Bool("all", false, "drop 时删除全部数据")
+	flags.Parse(args[1:])
+	if action == "drop" && len(ids) == 0 && !*all {
+		return errors.New("--id or --all is required")
+	}
+
+	conf := config.GetConfig()
+	jobConfigs, err := selectJobs(conf, *jobName)
+	if err != nil {
+		return err
+	}
+	sqlLitedb, err := dao.ConnectDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer sqlLitedb.Close()
+
+	// 按 --id 筛选各任务的数据
+	selected := make(map[string][]dao.DeadLetter)
+	for _, jobConfig := range jobConfigs {
+		letters, err := dao.ListDeadLetters(sqlLitedb, jobConfig.Job)
+		if err != nil {
+			return err
+		}
+		for _, letter := range letters {
+			if len(ids) == 0 || containsId(ids, letter.Id) {
+				selected[jobConfig.Job] = append(selected[jobConfig.Job], letter)
+			}
+		}
+	}
+
+	switch action {
+	case "list":
+		for _, jobConfig := range jobConfigs {
+			letters := selected[jobConfig.Job]
+			fmt.Printf("job %s: %d skipped\n", jobLabel(jobConfig), len(letters))
+			for _, letter := range letters {
+				fmt.Printf("  #%d %s:%s at %s, %d attempts, last %s\n", letter.Id, letter.SourceTable, letter.SourceId,
+					letter.Stage, letter.Attempts, letter.UpdatedAt.Format("2006-01-02 15:04:05"))
+				fmt.Printf("     error: %s\n", letter.Error)
+				fmt.Printf("     row:   %s\n", letter.Row)
+			}
+		}
+		return nil
+	case "drop":
+		for _, jobConfig := range jobConfigs {
+			letters := selected[jobConfig.Job]
+			dropped := make([]int64, len(letters))
+			for i, letter := range letters {
+				dropped[i] = letter.Id
+			}
+			if err := dao.DeleteDeadLetters(sqlLitedb, dropped); err != nil {
+				return err
+			}
+			fmt.Printf("job %s: dropped %d\n", jobLabel(jobConfig), len(letters))
+		}
+		return nil
+	}
+
+	var retried []*config.Config
+	for _, jobConfig := range jobConfigs {
+		if len(selected[jobConfig.Job]) > 0 {
+			retried = append(retried, jobConfig)
+		}
+	}
+	jobs, err := openJobs(retried, sqlLitedb)
+	if err != nil {
+		return err
+	}
+	defer closeJobs(jobs)
+	for _, j := range jobs {
+		if err := retryDeadLetters(j, selected[j.conf.Job]); err != nil {
+			return fmt.Errorf("job %s: %v", jobLabel(j.conf), err)
+		}
+	}
+	return nil
+}
+
+// retryDeadLetters 持有运行锁, 按页重新同步一个任务中被跳过的数据, 同步成功或源数据已不存在的从中删除
+func retryDeadLetters(j *job, letters []dao.DeadLetter) error {
+	lock, err := j.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	defer j.readClient.EndRun()
+
+	if err := checkSchema(j.feishuClient); err != nil {
+		return fmt.Errorf("checking table schema: %v", err)
+	}
+
+	// 无法写回的飞书修改用源数据覆盖
+	var pulled []dao.DeadLetter
+	var pushed []dao.DeadLetter
+	for _, letter := range letters {
+		if letter.Stage == dao.StagePull {
+			pulled = append(pulled, letter)
+		} else {
+			pushed = append(pushed, letter)
+		}
+	}
+	if err := resyncDeadLetters(j, pulled); err != nil {
+		return err
+	}
+	letters = pushed
+
+	size := int(j.conf.Read.Mode.Rows)
+	remaining := 0
+	for offset := 0; offset < len(letters); offset += size {
+		end := offset + size
+		if end > len(letters) {
+			end = len(letters)
+		}
+		page := letters[offset:end]
+
+		records, err := j.readClient.RetryDeadLetters(page)
+		if err != nil {
+			return err
+		}
+		if err := syncPage(j.feishuClient, j.readClient, j.sqlLitedb, records); err != nil {
+			return err
+		}
+
+		var done []int64
+		for _, letter := range page {
+			if j.readClient.Failed(letter.SourceId) {
+				remaining++
+			} else {
+				done = append(done, letter.Id)
+			}
+		}
+		if err := dao.DeleteDeadLetters(j.sqlLitedb, done); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("job %s: retried %d, %d still failing\n", jobLabel(j.conf), len(letters)+len(pulled), remaining)
+	return nil
+}
+
+// resyncDeadLetters 将无法写回的飞书记录按源数据的当前内容重新更新到飞书, 完成后删除
+func resyncDeadLetters(j *job, letters []dao.DeadLetter) error {
+	size := int(j.conf.Read.Mode.Rows)
+	for offset := 0; offset < len(letters); offset += size {
+		end := offset + size
+		if end > len(letters) {
+			end = len(letters)
+		}
+		page := letters[offset:end]
+
+		ids := make([]string, len(page))
+		for i, letter := range page {
+			ids[i] = letter.SourceId
+		}
+		updates, entries, err := j.readClient.Resync(ids)
+		if err != nil {
+			return err
+		}
+		_, err = j.feishuClient.NewBatchUpdateRecord(updates, func(offset, count int) error {
+			return dao.SaveLedgerEntries(j.sqlLitedb, entries[offset:offset+count])
+		})
+		if err != nil {
+			return err
+		}
+
+		// 源数据无法转换时已重新记录为无法同步的数据
+		var done []int64
+		for _, letter := range page {
+			if !j.readClient.Failed(letter.SourceId) {
+				done = append(done, letter.Id)
+			}
+		}
+		if err := dao.DeleteDeadLetters(j.sqlLitedb, done); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsId 判断 ids 中是否包含 id
+func containsId(ids []int64, id int64) bool {
+	for _, value := range ids {
+		if value == id {
+			return true
+		}
+	}
+	return false
+}
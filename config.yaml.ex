@@ -2,18 +2,149 @@ database:
   driver: "sqlite3"
   source: "data.db"
 read:
+  # 源数据库驱动: mysql(默认)、postgres、sqlite3
+  driver: mysql
+  # mysql 和 postgres 以外的驱动使用的连接字符串, 例如 sqlite3 的数据库文件路径
+  # dsn: /data/tool/tool.db
   mysql:
     host: localhost
     port: 3306
     username: ydjl_web
     password: 222222222
     database: 222222222
+    # tls: true          # 使用 TLS 连接, skip-verify 时不校验服务器证书
+    # ca: /etc/mysql/ca.pem
+  # driver 为 postgres 时使用
+  # postgres:
+  #   host: localhost
+  #   port: 5432
+  #   username: feedback
+  #   password: 222222222
+  #   database: feedback
+  #   sslmode: disable
+  source:
+    table: book_user_feedback
+    id_column: id
+    columns: [id, des, email, user_id, add_date]
+    # 或使用完整SQL模板, {condition} 为筛选条件, 不能包含 ORDER BY 和 LIMIT
+    # query: "SELECT id, des, email, user_id, add_date FROM book_user_feedback WHERE {condition}"
+    # 增量方式: id 按自增主键, timestamp 按时间字段(时间相同时按主键区分)
+    watermark:
+      mode: id
+      # column: updated_at
   mode:
-    rows: 50
+    rows: 500
+  # 从 CSV 或 JSON Lines 文件读取数据, 设置后不再连接数据库
+  # file:
+  #   path: /data/export/feedback.csv
+  #   format: csv
+  #   delimiter: ","
+  # 读取完现有数据后持续读取 binlog 实时同步, 需要 binlog_format=ROW
+  binlog:
+    enabled: false
+    server_id: 1001
+# 多维表格字段映射, column(源字段)、value(常量)、template(模板) 三选一
+# type 为字段类型, 默认为 text
+mapping:
+  - field: 需求描述
+    column: des
+  - field: 需求分类
+    value: 用户需求反馈
+    type: single_select
+  - field: 需求状态
+    value: 待评估
+    type: single_select
+  - field: 优先级
+    value: 低 - P2
+    type: single_select
+  - field: 需求提出日期
+    column: add_date
+    type: date
+    timezone: Asia/Shanghai
+  - field: 需求详细描述（可附文档）
+    template: "{{.des}}{{with trim .email}} 联系方式: {{.}}{{end}}"
+  - field: 父记录
+    value: [recumeyGcqvGUP]
+    type: link
+sync:
+  # 将已同步数据的修改更新到多维表格
+  update:
+    enabled: false
+    # 更新时间字段, 为空时比较全部已同步数据的内容哈希
+    column: updated_at
+  # 源数据被删除后删除或归档对应的多维表格记录
+  delete:
+    enabled: false
+    # delete 删除记录, archive 将 archive_field 设置为 archive_value
+    mode: archive
+    # 软删除标记字段及表示已删除的值, 为空时只处理物理删除
+    column: is_deleted
+    value: 1
+    archive_field: 需求状态
+    archive_value: 已归档
+    # 一次运行最多删除的记录数和占已同步记录的比例, 超过任何一个时不删除并报错, 避免配置错误时删除全部记录
+    max_count: 0
+    max_ratio: 0.5
+  # 将多维表格中修改的字段写回源表
+  pull:
+    enabled: false
+    # 多维表格中的"最后更新时间"字段, 为空时每次读取全部记录
+    modified_field: 最后更新时间
+    fields:
+      - field: 需求状态
+        column: status
+      - field: 优先级
+        column: priority
+  # 写回字段在两边都被修改时的处理方式: manual(默认)、lww、source、bitable
+  conflict:
+    default: manual
+    # lww 比较的源表修改时间字段及其时区
+    column: updated_at
+    timezone: Asia/Shanghai
+    fields:
+      需求状态: bitable
 feishu:
   app:
     id: 2222222222222222
     secret: 1111111
   drive:
     base_id: 333333333333333
-    table_id: 444444
\ No newline at end of file
+    table_id: 444444
+  batch:
+    size: 500
+  # 同步前检查数据表结构, provision 为 dry_run 时列出需要的修改, 为 create 时新建缺少的字段和选项
+  schema:
+    provision: ""
+  # 网络错误、5xx 和限流时的重试策略
+  retry:
+    attempts: 3
+    backoff: 500ms
+    max_backoff: 30s
+    jitter: 0.2
+  # 接收多维表格记录变更事件, 实时写回源数据库, 需要开启 sync.pull
+  event:
+    enabled: false
+    addr: :8080
+    path: /webhook/event
+    verification_token: xxxxxxxx
+    encrypt_key: xxxxxxxx
+    max_attempts: 5 # 处理失败的事件最多尝试的次数, 之后不再重试
+# daemon 模式下的运行时间, interval 和 cron 二选一
+schedule:
+  interval: 1m
+  # cron: "*/5 * * * *"
+# 多个同步任务, 未设置的 read、sync、drive、schedule 配置项使用上面的配置, 设置 mapping 时替换上面的 mapping
+#jobs:
+#  - name: feedback
+#  - name: orders
+#    schedule:
+#      cron: "0 * * * *"
+#    read:
+#      source:
+#        table: orders
+#        columns: [id, title, add_date]
+#    mapping:
+#      - field: 订单标题
+#        column: title
+#    drive:
+#      table_id: 555555
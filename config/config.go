@@ -1,26 +1,178 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v3"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 type Read struct {
+	// Driver 源数据库的 database/sql 驱动名: mysql(默认)、postgres、sqlite3 等已编译进程序的驱动
+	Driver string `yaml:"driver"`
+	// Dsn 连接字符串, mysql 和 postgres 以外的驱动必须设置, 例如 sqlite3 的数据库文件路径;
+	// postgres 设置后忽略 Postgres 中的配置
+	Dsn   string `yaml:"dsn"`
 	Mysql struct {
 		Host     string `yaml:"host"`
 		Port     int    `yaml:"port"`
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
 		Database string `yaml:"database"`
+		TLS      string `yaml:"tls"` // true 校验服务器证书, skip-verify 不校验, 默认不使用 TLS
+		CA       string `yaml:"ca"`  // 校验服务器证书的 CA 证书文件, 默认使用系统证书
 	} `yaml:"mysql"`
-	Mode struct {
-		Rows int64 `yaml:"rows"` // 当差异大于这个数值时,则报警
+	Postgres struct {
+		Host     string `yaml:"host"`
+		Port     int    `yaml:"port"` // 默认为 5432
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		Database string `yaml:"database"`
+		SSLMode  string `yaml:"sslmode"` // disable(默认)、require、verify-ca、verify-full
+	} `yaml:"postgres"`
+	Source Source `yaml:"source"`
+	Mode   struct {
+		Rows int64 `yaml:"rows"` // 每页读取的源数据行数
 	} `yaml:"mode"`
+	// File 从 CSV(第一行为表头) 或 JSON Lines 文件读取源数据, 设置 path 后不再读取数据库
+	File struct {
+		Path      string `yaml:"path"`
+		Format    string `yaml:"format"`    // csv 或 jsonl, 默认按扩展名判断
+		Delimiter string `yaml:"delimiter"` // csv 的分隔符, 默认为逗号
+	} `yaml:"file"`
+	// Binlog 读取完现有数据后持续读取 binlog, 实时同步新建、修改和删除, 需要 binlog_format=ROW
+	Binlog struct {
+		Enabled  bool   `yaml:"enabled"`
+		ServerId uint32 `yaml:"server_id"` // 作为从库连接时使用的 server_id, 不能与其他从库重复, 默认为 1001
+	} `yaml:"binlog"`
+}
+
+// Source 描述需要同步的源表
+type Source struct {
+	Table    string   `yaml:"table"`     // 源表名
+	IdColumn string   `yaml:"id_column"` // 主键字段, id 增量模式下需为自增整数
+	Columns  []string `yaml:"columns"`   // 查询字段, 为空时查询全部字段
+	// Query 完整的SQL模板, 设置后忽略 Columns, 例如:
+	// SELECT id, des FROM book_user_feedback WHERE {condition}
+	// 其中 {condition} 会被替换为筛选条件, 模板中不能包含 ORDER BY 和 LIMIT, 分页时会自动追加
+	Query string `yaml:"query"`
+	// Watermark 增量同步方式
+	Watermark struct {
+		Mode   string `yaml:"mode"`   // id 按自增主键(默认), timestamp 按时间字段, 时间相同时按主键区分
+		Column string `yaml:"column"` // timestamp 模式下的时间字段, 例如 add_date 或 updated_at
+	} `yaml:"watermark"`
+}
+
+// Field 描述一个多维表格字段的取值方式, Column、Value、Template 三选一
+type Field struct {
+	Field    string      `yaml:"field"`    // 多维表格字段名
+	Column   string      `yaml:"column"`   // 源字段名
+	Value    interface{} `yaml:"value"`    // 常量
+	Template string      `yaml:"template"` // text/template 表达式, 以源记录为数据
+	// Type 字段类型: text、number、single_select、multi_select、date、checkbox、
+	// url、phone、person、link、location, 默认为 text
+	Type      string `yaml:"type"`
+	Timezone  string `yaml:"timezone"`  // date 类型的时区, 例如 Asia/Shanghai, 默认为 UTC
+	Layout    string `yaml:"layout"`    // date 类型的时间格式, 默认为 2006-01-02 15:04:05
+	Separator string `yaml:"separator"` // 列表类型拆分字符串时的分隔符, 默认为逗号
+}
+
+// Sync 新建之外的同步方式
+type Sync struct {
+	// Update 将已同步数据的修改更新到多维表格
+	Update struct {
+		Enabled bool   `yaml:"enabled"`
+		Column  string `yaml:"column"` // 更新时间字段, 为空时比较全部已同步数据的内容哈希
+	} `yaml:"update"`
+	// Delete 源数据被删除后删除或归档对应的多维表格记录
+	Delete struct {
+		Enabled      bool        `yaml:"enabled"`
+		Mode         string      `yaml:"mode"`          // delete 删除记录, archive 将 archive_field 设置为 archive_value
+		Column       string      `yaml:"column"`        // 软删除标记字段, 为空时只处理物理删除
+		Value        interface{} `yaml:"value"`         // 软删除标记字段表示已删除的值, 默认为 1
+		ArchiveField string      `yaml:"archive_field"` // 归档时设置的多维表格字段
+		ArchiveValue interface{} `yaml:"archive_value"` // 归档时设置的值
+		MaxCount     int         `yaml:"max_count"`     // 一次运行最多删除的记录数, 超过时不删除并报错, 0 为不限制
+		MaxRatio     float64     `yaml:"max_ratio"`     // 一次运行最多删除的记录占已同步记录的比例, 默认为 0.5, 1 为不限制
+	} `yaml:"delete"`
+	// Pull 将多维表格中修改的字段写回源数据库
+	Pull struct {
+		Enabled bool `yaml:"enabled"`
+		// ModifiedField 多维表格中的"最后更新时间"字段, 设置后由飞书按日期筛选, 否则每次写回都读取全部记录
+		ModifiedField string `yaml:"modified_field"`
+		// Fields 写回的字段, 需要设置 field 和 column, 未设置 type 时与 mapping 中的同名字段相同
+		Fields []Field `yaml:"fields"`
+	} `yaml:"pull"`
+	// Conflict 写回字段在两边都被修改时的处理方式
+	Conflict struct {
+		// Default 默认策略: manual(默认) 记录冲突, 两边都不修改; lww 修改时间晚的一边优先;
+		// source 字段属于源表, 多维表格的修改会被覆盖; bitable 字段属于多维表格, 源表的修改不再同步到多维表格
+		Default string `yaml:"default"`
+		// Fields 按多维表格字段名设置策略, 覆盖 Default
+		Fields map[string]string `yaml:"fields"`
+		// Column lww 策略比较的源表修改时间字段, 默认为 sync.update.column
+		Column string `yaml:"column"`
+		// Timezone 源表修改时间的时区, 默认为 Local
+		Timezone string `yaml:"timezone"`
+		// Layout 源表修改时间为字符串时的格式, 与 mapping 中日期字段的 layout 相同
+		Layout string `yaml:"layout"`
+	} `yaml:"conflict"`
+}
+
+// 写回字段的冲突处理策略
+const (
+	ConflictSource  = "source"
+	ConflictBitable = "bitable"
+	ConflictLWW     = "lww"
+	ConflictManual  = "manual"
+)
+
+// Retry 调用飞书接口失败时的重试策略
+type Retry struct {
+	Attempts   int           `yaml:"attempts"`    // 最多尝试次数, 包含第一次请求
+	Backoff    time.Duration `yaml:"backoff"`     // 第一次重试前的等待时间, 之后按指数增长
+	MaxBackoff time.Duration `yaml:"max_backoff"` // 最长等待时间
+	Jitter     float64       `yaml:"jitter"`      // 等待时间的随机浮动比例, 0~1
+}
+
+// Job 一个同步任务, 将一个源表同步到一个数据表. read、sync、drive、schedule 中未设置的配置项使用顶层的
+// read、sync、feishu.drive、schedule, 设置了 mapping 时替换顶层的 mapping
+type Job struct {
+	Name     string    `yaml:"name"` // 任务名, 只能包含字母、数字、- 和 _
+	Read     yaml.Node `yaml:"read"`
+	Mapping  yaml.Node `yaml:"mapping"`
+	Sync     yaml.Node `yaml:"sync"`
+	Drive    yaml.Node `yaml:"drive"`
+	Schedule yaml.Node `yaml:"schedule"`
+}
+
+// Schedule daemon 模式下任务的运行时间, Cron 和 Interval 二选一
+type Schedule struct {
+	Cron     string        `yaml:"cron"`     // 标准 cron 表达式(分 时 日 月 周), 例如 */5 * * * *
+	Interval time.Duration `yaml:"interval"` // 固定的运行间隔, 例如 1m
+}
+
+// Spec 转换为 cron 的表达式, 未设置时为空
+func (s Schedule) Spec() string {
+	if s.Cron != "" {
+		return s.Cron
+	}
+	if s.Interval > 0 {
+		return "@every " + s.Interval.String()
+	}
+	return ""
 }
 
+// MaxBatchSize 多维表格批量接口单次最多处理的记录数
+const MaxBatchSize = 500
+
 // Config represents the configuration structure
 type Config struct {
 	Database struct {
@@ -30,6 +182,13 @@ type Config struct {
 
 	Read Read `yaml:"read"`
 
+	Mapping []Field `yaml:"mapping"`
+
+	Sync Sync `yaml:"sync"`
+
+	// Schedule daemon 模式下的运行时间
+	Schedule Schedule `yaml:"schedule"`
+
 	FeiShu struct {
 		App struct {
 			Id     string `yaml:"id"`
@@ -39,9 +198,41 @@ type Config struct {
 			BaseId  string `yaml:"base_id"`
 			TableId string `yaml:"table_id"`
 		} `yaml:"drive"`
+		Batch struct {
+			Size int `yaml:"size"` // 每次批量新建的记录数, 最大 500
+		} `yaml:"batch"`
+		Retry Retry `yaml:"retry"`
+		// Schema 同步前检查数据表结构
+		Schema struct {
+			// Provision 自动修复数据表结构: 为空时只检查; dry_run 列出需要新建的字段和追加的选项;
+			// create 新建缺少的字段, 为单选、多选字段追加缺少的选项
+			Provision string `yaml:"provision"`
+		} `yaml:"schema"`
+		// Event 接收多维表格记录变更事件, 实时将修改写回源数据库, 需要同时开启 sync.pull
+		Event struct {
+			Enabled           bool   `yaml:"enabled"`
+			Addr              string `yaml:"addr"`               // 监听地址, 默认为 :8080
+			Path              string `yaml:"path"`               // 请求地址路径, 默认为 /webhook/event
+			VerificationToken string `yaml:"verification_token"` // 事件订阅的 Verification Token
+			EncryptKey        string `yaml:"encrypt_key"`        // 事件订阅的 Encrypt Key, 设置后校验签名并解密事件
+			MaxAttempts       int    `yaml:"max_attempts"`       // 事件处理失败的最多次数, 之后不再重试, 默认为 5
+		} `yaml:"event"`
 	} `yaml:"feishu"`
+
+	// Jobs 多个同步任务, 为空时按顶层配置运行一个任务
+	Jobs []Job `yaml:"jobs"`
+	// Job 任务名, 只在由 jobs 生成的任务配置中设置, 用于区分各任务在本地数据库中的状态
+	Job string `yaml:"-"`
+
+	jobConfigs []*Config
 }
 
+// 自动修复数据表结构的方式
+const (
+	ProvisionDryRun = "dry_run"
+	ProvisionCreate = "create"
+)
+
 // GlobalConfig 存储全局配置
 var GlobalConfig *Config
 var configOnce sync.Once
@@ -72,18 +263,363 @@ func ReadConfig(filename string) (*Config, error) {
 	// 创建配置文件的完整路径
 	configPath := filepath.Join(baseDir, filename)
 
-	file, err := os.Open(configPath)
+	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
 	var config Config
-	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&config)
+	err = yaml.Unmarshal(data, &config)
 
 	if err != nil {
 		return nil, err
 	}
+	if len(config.Jobs) == 0 {
+		if err := config.setDefaults(); err != nil {
+			return nil, err
+		}
+		config.jobConfigs = []*Config{&config}
+	} else {
+		// 顶层配置只作为各任务的默认值, 不单独检查
+		if err := config.feishuDefaults(); err != nil {
+			return nil, err
+		}
+		if err := config.buildJobs(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.FeiShu.Event.Enabled {
+		pull := false
+		for _, job := range config.jobConfigs {
+			pull = pull || job.Sync.Pull.Enabled
+		}
+		if !pull {
+			return nil, errors.New("feishu.event requires sync.pull to be enabled")
+		}
+	}
 	return &config, nil
 }
+
+// buildJobs 为 jobs 中的每个任务生成完整的配置. 每个任务重新解析整个配置文件作为默认值,
+// 任务之间不共享列表和 map
+func (c *Config) buildJobs(data []byte) error {
+	names := make(map[string]bool)
+	for i := range c.Jobs {
+		job := &c.Jobs[i]
+		if !jobNamePattern.MatchString(job.Name) {
+			return fmt.Errorf("jobs[%d]: invalid name %q", i, job.Name)
+		}
+		if names[job.Name] {
+			return fmt.Errorf("jobs: duplicate name %s", job.Name)
+		}
+		names[job.Name] = true
+
+		var jobConfig Config
+		if err := yaml.Unmarshal(data, &jobConfig); err != nil {
+			return err
+		}
+		parts := []struct {
+			node *yaml.Node
+			out  interface{}
+		}{
+			{&job.Read, &jobConfig.Read},
+			{&job.Mapping, &jobConfig.Mapping},
+			{&job.Sync, &jobConfig.Sync},
+			{&job.Drive, &jobConfig.FeiShu.Drive},
+			{&job.Schedule, &jobConfig.Schedule},
+		}
+		for _, part := range parts {
+			if part.node.IsZero() {
+				continue
+			}
+			if err := part.node.Decode(part.out); err != nil {
+				return fmt.Errorf("jobs.%s: %v", job.Name, err)
+			}
+		}
+
+		jobConfig.Jobs = nil
+		jobConfig.Job = job.Name
+		if err := jobConfig.setDefaults(); err != nil {
+			return fmt.Errorf("jobs.%s: %v", job.Name, err)
+		}
+		jobConfig.jobConfigs = []*Config{&jobConfig}
+		c.jobConfigs = append(c.jobConfigs, &jobConfig)
+	}
+	return nil
+}
+
+// jobNamePattern 任务名的格式, 任务名会作为本地状态的前缀
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// JobConfigs 返回全部任务的配置, 未配置 jobs 时只有顶层配置本身
+func (c *Config) JobConfigs() []*Config {
+	return c.jobConfigs
+}
+
+// JobConfig 按任务名查找任务的配置
+func (c *Config) JobConfig(name string) (*Config, error) {
+	for _, job := range c.jobConfigs {
+		if job.Job == name {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("job %s not found", name)
+}
+
+// StateKey 本地数据库中状态的键, 多任务时以任务名为前缀, 避免不同任务的进度互相覆盖
+func (c *Config) StateKey(key string) string {
+	if c.Job == "" {
+		return key
+	}
+	return c.Job + "/" + key
+}
+
+// LedgerTable 对应关系和冲突记录中的源表名
+func (c *Config) LedgerTable() string {
+	return c.StateKey(c.Read.Source.Table)
+}
+
+// setDefaults 填充未配置项的默认值, 兼容旧版本配置文件, 并检查配置是否有效
+func (c *Config) setDefaults() error {
+	if c.Read.Driver == "" {
+		c.Read.Driver = "mysql"
+	}
+	if c.Read.Driver != "mysql" && c.Read.Driver != "postgres" && c.Read.Dsn == "" {
+		return fmt.Errorf("read.dsn is required for driver %s", c.Read.Driver)
+	}
+	if c.Read.Postgres.Port == 0 {
+		c.Read.Postgres.Port = 5432
+	}
+	if c.Read.Postgres.SSLMode == "" {
+		c.Read.Postgres.SSLMode = "disable"
+	}
+	if c.Read.File.Path != "" {
+		if err := c.fileDefaults(); err != nil {
+			return err
+		}
+	}
+	if c.Read.Source.Table == "" {
+		c.Read.Source.Table = "book_user_feedback"
+		if len(c.Read.Source.Columns) == 0 && c.Read.Source.Query == "" {
+			c.Read.Source.Columns = []string{"id", "des", "email", "user_id", "add_date"}
+		}
+	}
+	if c.Read.Source.IdColumn == "" {
+		c.Read.Source.IdColumn = "id"
+	}
+	if c.Read.Source.Watermark.Mode == "" {
+		c.Read.Source.Watermark.Mode = "id"
+	}
+	if c.Read.Source.Watermark.Mode != "id" && c.Read.Source.Watermark.Mode != "timestamp" {
+		return fmt.Errorf("read.source.watermark.mode must be id or timestamp, got %q", c.Read.Source.Watermark.Mode)
+	}
+	if c.Read.Source.Watermark.Mode == "timestamp" && c.Read.Source.Watermark.Column == "" {
+		return errors.New("read.source.watermark.column is required in timestamp mode")
+	}
+	if c.Read.Mode.Rows <= 0 {
+		c.Read.Mode.Rows = 500
+	}
+	if c.Read.Binlog.Enabled && c.Read.Driver != "mysql" {
+		return errors.New("read.binlog is only supported by the mysql driver")
+	}
+	switch c.Read.Mysql.TLS {
+	case "", "false", "true", "skip-verify":
+	default:
+		return fmt.Errorf("read.mysql.tls must be true, false or skip-verify, got %q", c.Read.Mysql.TLS)
+	}
+	if c.Read.Binlog.ServerId == 0 {
+		c.Read.Binlog.ServerId = 1001
+	}
+	if c.Sync.Delete.Mode == "" {
+		c.Sync.Delete.Mode = "delete"
+	}
+	if c.Sync.Delete.Mode != "delete" && c.Sync.Delete.Mode != "archive" {
+		return fmt.Errorf("sync.delete.mode must be delete or archive, got %q", c.Sync.Delete.Mode)
+	}
+	if c.Sync.Delete.Enabled && c.Sync.Delete.Mode == "archive" && c.Sync.Delete.ArchiveField == "" {
+		return errors.New("sync.delete.archive_field is required in archive mode")
+	}
+	if c.Sync.Delete.Value == nil {
+		c.Sync.Delete.Value = 1
+	}
+	if c.Sync.Delete.MaxRatio == 0 {
+		c.Sync.Delete.MaxRatio = 0.5
+	}
+	if c.Sync.Delete.MaxRatio < 0 || c.Sync.Delete.MaxRatio > 1 {
+		return fmt.Errorf("sync.delete.max_ratio must be between 0 and 1, got %v", c.Sync.Delete.MaxRatio)
+	}
+	if c.Sync.Delete.MaxCount < 0 {
+		return fmt.Errorf("sync.delete.max_count must not be negative, got %d", c.Sync.Delete.MaxCount)
+	}
+	if err := c.feishuDefaults(); err != nil {
+		return err
+	}
+	if len(c.Mapping) == 0 {
+		c.Mapping = defaultMapping()
+	}
+	if c.Sync.Pull.Enabled && len(c.Sync.Pull.Fields) == 0 {
+		return errors.New("sync.pull.fields is required when pull is enabled")
+	}
+	for i, field := range c.Sync.Pull.Fields {
+		if field.Type != "" {
+			continue
+		}
+		for _, mapping := range c.Mapping {
+			if mapping.Field == field.Field {
+				c.Sync.Pull.Fields[i].Type = mapping.Type
+				c.Sync.Pull.Fields[i].Timezone = mapping.Timezone
+				c.Sync.Pull.Fields[i].Layout = mapping.Layout
+				c.Sync.Pull.Fields[i].Separator = mapping.Separator
+				break
+			}
+		}
+	}
+	if err := c.conflictDefaults(); err != nil {
+		return err
+	}
+	if c.Schedule.Cron != "" && c.Schedule.Interval != 0 {
+		return errors.New("schedule: cron and interval cannot both be set")
+	}
+	if c.Schedule.Interval < 0 {
+		return fmt.Errorf("schedule.interval must be positive, got %s", c.Schedule.Interval)
+	}
+	if c.Schedule.Cron != "" {
+		if _, err := cron.ParseStandard(c.Schedule.Cron); err != nil {
+			return fmt.Errorf("schedule.cron: %v", err)
+		}
+	}
+	return nil
+}
+
+// feishuDefaults 填充各任务共用的飞书配置的默认值
+func (c *Config) feishuDefaults() error {
+	if c.FeiShu.Batch.Size <= 0 || c.FeiShu.Batch.Size > MaxBatchSize {
+		c.FeiShu.Batch.Size = MaxBatchSize
+	}
+	if c.FeiShu.Retry.Attempts <= 0 {
+		c.FeiShu.Retry.Attempts = 3
+	}
+	if c.FeiShu.Retry.Backoff <= 0 {
+		c.FeiShu.Retry.Backoff = 500 * time.Millisecond
+	}
+	if c.FeiShu.Retry.MaxBackoff <= 0 {
+		c.FeiShu.Retry.MaxBackoff = 30 * time.Second
+	}
+	// 浮动比例超过 1 时等待时间可能为负数, 等于不退避
+	if c.FeiShu.Retry.Jitter < 0 {
+		c.FeiShu.Retry.Jitter = 0
+	}
+	if c.FeiShu.Retry.Jitter > 1 {
+		c.FeiShu.Retry.Jitter = 1
+	}
+	if c.FeiShu.Event.Addr == "" {
+		c.FeiShu.Event.Addr = ":8080"
+	}
+	if c.FeiShu.Event.Path == "" {
+		c.FeiShu.Event.Path = "/webhook/event"
+	}
+	if c.FeiShu.Event.MaxAttempts <= 0 {
+		c.FeiShu.Event.MaxAttempts = 5
+	}
+	switch c.FeiShu.Schema.Provision {
+	case "", ProvisionDryRun, ProvisionCreate:
+	default:
+		return fmt.Errorf("feishu.schema.provision must be dry_run or create, got %q", c.FeiShu.Schema.Provision)
+	}
+	return nil
+}
+
+// conflictDefaults 填充冲突策略的默认值, 检查每个写回字段的策略
+func (c *Config) conflictDefaults() error {
+	conflict := &c.Sync.Conflict
+	if conflict.Default == "" {
+		conflict.Default = ConflictManual
+	}
+	if conflict.Column == "" {
+		conflict.Column = c.Sync.Update.Column
+	}
+	if conflict.Timezone == "" {
+		conflict.Timezone = "Local"
+	}
+	if _, err := time.LoadLocation(conflict.Timezone); err != nil {
+		return fmt.Errorf("sync.conflict.timezone: %v", err)
+	}
+
+	for name := range conflict.Fields {
+		found := false
+		for _, field := range c.Sync.Pull.Fields {
+			if field.Field == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("sync.conflict.fields: %s is not a pull field", name)
+		}
+	}
+	for _, field := range c.Sync.Pull.Fields {
+		switch policy := c.ConflictPolicy(field.Field); policy {
+		case ConflictSource, ConflictBitable, ConflictManual:
+		case ConflictLWW:
+			if conflict.Column == "" {
+				return fmt.Errorf("sync.conflict.column is required by the lww policy of %s", field.Field)
+			}
+		default:
+			return fmt.Errorf("sync.conflict: unknown policy %q for %s", policy, field.Field)
+		}
+	}
+	return nil
+}
+
+// ConflictPolicy 返回写回字段的冲突处理策略, field 为多维表格字段名
+func (c *Config) ConflictPolicy(field string) string {
+	if policy, ok := c.Sync.Conflict.Fields[field]; ok {
+		return policy
+	}
+	return c.Sync.Conflict.Default
+}
+
+// defaultMapping 未配置 mapping 时使用的用户需求反馈映射
+func defaultMapping() []Field {
+	return []Field{
+		{Field: "需求描述", Column: "des"},
+		{Field: "需求分类", Value: "用户需求反馈", Type: "single_select"},
+		{Field: "需求状态", Value: "待评估", Type: "single_select"},
+		{Field: "优先级", Value: "低 - P2", Type: "single_select"},
+		{Field: "需求提出日期", Column: "add_date", Type: "date"},
+		{Field: "需求详细描述（可附文档）", Template: `{{.des}}{{with trim .email}} 联系方式: {{.}}{{end}}`},
+		{Field: "父记录", Value: []interface{}{"recumeyGcqvGUP"}, Type: "link"},
+	}
+}
+
+// fileDefaults 填充文件数据源的默认值, 文件数据源只支持新建和按对应关系更新
+func (c *Config) fileDefaults() error {
+	if c.Read.File.Format == "" {
+		switch strings.ToLower(filepath.Ext(c.Read.File.Path)) {
+		case ".csv":
+			c.Read.File.Format = "csv"
+		case ".jsonl", ".ndjson":
+			c.Read.File.Format = "jsonl"
+		default:
+			return fmt.Errorf("read.file.format is required for %s", c.Read.File.Path)
+		}
+	}
+	if c.Read.File.Format != "csv" && c.Read.File.Format != "jsonl" {
+		return fmt.Errorf("read.file.format must be csv or jsonl, got %q", c.Read.File.Format)
+	}
+	if c.Read.File.Delimiter == "" {
+		c.Read.File.Delimiter = ","
+	}
+	if utf8.RuneCountInString(c.Read.File.Delimiter) != 1 {
+		return fmt.Errorf("read.file.delimiter must be a single character, got %q", c.Read.File.Delimiter)
+	}
+	// 对应关系按表名区分, 默认使用文件名
+	if c.Read.Source.Table == "" {
+		c.Read.Source.Table = filepath.Base(c.Read.File.Path)
+	}
+	if c.Sync.Update.Enabled || c.Sync.Delete.Enabled || c.Sync.Pull.Enabled || c.Read.Binlog.Enabled {
+		return errors.New("sync.update, sync.delete, sync.pull and read.binlog are not supported by the file source")
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package dao
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Conflict 写回字段在源表和多维表格中都被修改的记录
+type Conflict struct {
+	SourceTable string
+	SourceId    string
+	RecordId    string
+	Field       string  // 多维表格字段名
+	Column      string  // 源字段名
+	Base        *string // 上次同步后两边一致的值, nil 表示为空或未知
+	Source      *string // 源表中的值
+	Bitable     *string // 多维表格中的值, 已转换为写回源表的格式
+	Policy      string  // 冲突处理策略
+	Resolution  string  // source 或 bitable 表示保留的一边, 为空表示待人工处理
+}
+
+// EnsureConflictTable 确保 conflicts 表存在
+func EnsureConflictTable(db *sql.DB) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS conflicts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			source_table TEXT NOT NULL,
+			source_id TEXT NOT NULL,
+			record_id TEXT NOT NULL,
+			field TEXT NOT NULL,
+			column_name TEXT NOT NULL,
+			base_value TEXT,
+			source_value TEXT,
+			bitable_value TEXT,
+			policy TEXT NOT NULL,
+			resolution TEXT,
+			created_at DATETIME,
+			resolved_at DATETIME
+		)`
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_conflicts_source ON conflicts (source_table, source_id)`)
+	return err
+}
+
+// SaveConflict 保存一条冲突. 同一字段已有待处理的冲突时更新其中的值, 不重复记录
+func SaveConflict(db *sql.DB, conflict Conflict) error {
+	if err := EnsureConflictTable(db); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var resolution sql.NullString
+	var resolvedAt sql.NullTime
+	if conflict.Resolution != "" {
+		resolution = sql.NullString{String: conflict.Resolution, Valid: true}
+		resolvedAt = sql.NullTime{Time: now, Valid: true}
+	}
+
+	result, err := db.Exec(`
+		UPDATE conflicts SET record_id = ?, source_value = ?, bitable_value = ?, policy = ?, resolution = ?, resolved_at = ?
+		WHERE source_table = ? AND source_id = ? AND field = ? AND resolution IS NULL`,
+		conflict.RecordId, conflict.Source, conflict.Bitable, conflict.Policy, resolution, resolvedAt,
+		conflict.SourceTable, conflict.SourceId, conflict.Field)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO conflicts (source_table, source_id, record_id, field, column_name, base_value, source_value, bitable_value,
+			policy, resolution, created_at, resolved_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		conflict.SourceTable, conflict.SourceId, conflict.RecordId, conflict.Field, conflict.Column,
+		conflict.Base, conflict.Source, conflict.Bitable, conflict.Policy, resolution, now, resolvedAt)
+	return err
+}
+
+// OpenConflictFields 返回源数据待人工处理的冲突字段(多维表格字段名)
+func OpenConflictFields(db *sql.DB, sourceTable string, sourceId string) ([]string, error) {
+	if err := EnsureConflictTable(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT field FROM conflicts WHERE source_table = ? AND source_id = ? AND resolution IS NULL`,
+		sourceTable, sourceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fields []string
+	for rows.Next() {
+		var field string
+		if err := rows.Scan(&field); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, rows.Err()
+}
+
+// ResolveConflict 两边的值已经一致时, 将字段待处理的冲突标记为已解决
+func ResolveConflict(db *sql.DB, sourceTable string, sourceId string, field string) error {
+	if err := EnsureConflictTable(db); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`UPDATE conflicts SET resolution = 'agreed', resolved_at = ?
+		WHERE source_table = ? AND source_id = ? AND field = ? AND resolution IS NULL`,
+		time.Now(), sourceTable, sourceId, field)
+	return err
+}
@@ -1,19 +1,24 @@
 package dao
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
-	"log"
+	"github.com/go-sql-driver/mysql"
+	"net"
 	"os"
 	"path/filepath"
 	"ser163.cn/earthworm/config"
 	"ser163.cn/earthworm/utils"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// 连接Sqlite
+// 连接Sqlite, 配置了 jobs 时将升级前未命名任务的本地状态迁移到第一个任务
 func ConnectDatabase(config *config.Config) (*sql.DB, error) {
 	source := config.Database.Source
 	if !utils.FileExists(source) {
@@ -36,9 +41,57 @@ func ConnectDatabase(config *config.Config) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	// 升级为多任务配置后, 原来的本地状态属于第一个任务
+	if len(config.Jobs) > 0 {
+		if err := MigrateLegacyJob(db, config.JobConfigs()[0].Job); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
 	return db, nil
 }
 
+// CopyDatabase 将本地数据库复制到临时文件并连接, 用于不修改本地数据库的运行, 返回的文件由调用方删除
+func CopyDatabase(db *sql.DB, driver string) (*sql.DB, string, error) {
+	file, err := os.CreateTemp("", "earthworm-*.db")
+	if err != nil {
+		return nil, "", err
+	}
+	path := file.Name()
+	file.Close()
+	// VACUUM INTO 要求目标文件不存在
+	os.Remove(path)
+
+	if _, err := db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return nil, "", err
+	}
+	copyDb, err := sql.Open(driver, path)
+	if err != nil {
+		os.Remove(path)
+		return nil, "", err
+	}
+	return copyDb, path, nil
+}
+
+// ConnectSourceDatabase 按 read.driver 连接源数据库
+func ConnectSourceDatabase(config *config.Config) (*sql.DB, error) {
+	driver := config.Read.Driver
+	switch {
+	case driver == "mysql":
+		return ConnectMysqlDatabase(config)
+	case driver == "postgres" && config.Read.Dsn == "":
+		return ConnectPostgresDatabase(config)
+	}
+
+	for _, name := range sql.Drivers() {
+		if name == driver {
+			return sql.Open(driver, config.Read.Dsn)
+		}
+	}
+	return nil, fmt.Errorf("driver %s is not registered, available drivers: %s", driver, strings.Join(sql.Drivers(), ", "))
+}
+
 // 连接mysql 数据库
 func ConnectMysqlDatabase(config *config.Config) (*sql.DB, error) {
 	host := config.Read.Mysql.Host
@@ -47,15 +100,47 @@ func ConnectMysqlDatabase(config *config.Config) (*sql.DB, error) {
 	dbName := config.Read.Mysql.Database
 	port := config.Read.Mysql.Port
 
-	// 连接 MySQL 数据库
-	dsn := userName + ":" + pass + "@tcp(" + host + ":" + strconv.Itoa(port) + ")/" + dbName
-	db, err := sql.Open("mysql", dsn)
-
+	// 连接 MySQL 数据库, 由驱动生成 DSN, 避免密码中的特殊字符破坏格式
+	mysqlConfig := mysql.NewConfig()
+	mysqlConfig.User = userName
+	mysqlConfig.Passwd = pass
+	mysqlConfig.Net = "tcp"
+	mysqlConfig.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	mysqlConfig.DBName = dbName
+	tlsConfig, err := MysqlTLSConfig(config)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	return db, nil
+	mysqlConfig.TLS = tlsConfig
+	connector, err := mysql.NewConnector(mysqlConfig)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// MysqlTLSConfig 按 read.mysql.tls 生成连接 MySQL 时使用的 TLS 配置, 不使用 TLS 时返回 nil
+func MysqlTLSConfig(config *config.Config) (*tls.Config, error) {
+	settings := config.Read.Mysql
+	switch settings.TLS {
+	case "", "false":
+		return nil, nil
+	case "skip-verify":
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: settings.Host}
+	if settings.CA != "" {
+		pem, err := os.ReadFile(settings.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", settings.CA)
+		}
+	}
+	return tlsConfig, nil
 }
 
 func CreateTable(db *sql.DB, tableName string) error {
@@ -100,6 +185,35 @@ func DropTable(db *sql.DB, tableName string) error {
 	return nil
 }
 
+// AddColumnIfMissing 为 SQLite 表添加缺少的字段, 用于升级旧版本创建的表
+func AddColumnIfMissing(db *sql.DB, tableName string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", tableName))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, columnType string
+		var notNull, primaryKey int
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, column, definition))
+	return err
+}
+
 // InsertOrUpdateToken 插入或更新token
 func InsertOrUpdateToken(db *sql.DB, token string, expiresAt time.Time) error {
 	// 更新或插入新的 token 记录
@@ -122,3 +236,116 @@ func GetToken(db *sql.DB) (string, time.Time, error) {
 	}
 	return token, expiresAt, nil
 }
+
+// BadValue 无法按字段类型转换的值, 保留驱动返回的原始值. 读取源数据时整行记录为无法同步的数据后跳过
+type BadValue struct {
+	Raw interface{}
+	Err error
+}
+
+// MarshalJSON 保存无法同步的数据时输出原始值
+func (v BadValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.Raw)
+}
+
+// ScanRows 按照 rows.ColumnTypes() 将查询结果逐行读取为 map, 任何一个值无法转换时返回错误
+func ScanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
+	records, _, err := scanRows(rows, "", false)
+	return records, err
+}
+
+// ScanSourceRows 与 ScanRows 相同, 用于读取需要同步的源数据: 无法转换的值保存为 BadValue, 不影响其他行,
+// 由调用方通过 RowError 找出并跳过. column 不为空时同时返回每行该字段驱动返回的原始值;
+// ScanRows 将时间格式化为精确到秒的字符串, 原始值保留完整的精度和时区, 用于保存同步进度
+func ScanSourceRows(rows *sql.Rows, column string) ([]map[string]interface{}, []interface{}, error) {
+	return scanRows(rows, column, true)
+}
+
+// RowError 返回一行源数据中第一个无法转换的值的错误, 都可以转换时返回 nil
+func RowError(record map[string]interface{}) error {
+	var names []string
+	for name, value := range record {
+		if _, ok := value.(BadValue); ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return fmt.Errorf("column %s: %v", names[0], record[names[0]].(BadValue).Err)
+}
+
+// scanRows 逐行读取查询结果, column 不为空时同时返回该字段的原始值. lenient 为 true 时无法转换的值保存为 BadValue
+func scanRows(rows *sql.Rows, column string, lenient bool) ([]map[string]interface{}, []interface{}, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []map[string]interface{}
+	var raws []interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columnTypes))
+		pointers := make([]interface{}, len(columnTypes))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		// 扫描到 interface{} 时只复制驱动返回的值, 出错时无法确定是哪一行, 不能只跳过一行
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, nil, err
+		}
+
+		record := make(map[string]interface{}, len(columnTypes))
+		var raw interface{}
+		for i, columnType := range columnTypes {
+			value := values[i]
+			if b, ok := value.([]byte); ok {
+				value = string(b)
+			}
+			normalized, err := normalizeValue(columnType, values[i])
+			if err != nil {
+				if !lenient {
+					return nil, nil, fmt.Errorf("column %s: %v", columnType.Name(), err)
+				}
+				normalized = BadValue{Raw: value, Err: err}
+			}
+			record[columnType.Name()] = normalized
+			if columnType.Name() == column {
+				raw = value
+			}
+		}
+		records = append(records, record)
+		raws = append(raws, raw)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return records, raws, nil
+}
+
+// normalizeValue 将驱动返回的原始值按字段类型转换为 int64、float64、string 等基础类型
+func normalizeValue(columnType *sql.ColumnType, value interface{}) (interface{}, error) {
+	raw, ok := value.([]byte)
+	if !ok {
+		if t, ok := value.(time.Time); ok {
+			return t.Format("2006-01-02 15:04:05"), nil
+		}
+		return value, nil
+	}
+
+	typeName := strings.ToUpper(columnType.DatabaseTypeName())
+	switch {
+	case strings.Contains(typeName, "INT") || typeName == "YEAR":
+		if n, err := strconv.ParseInt(string(raw), 10, 64); err == nil {
+			return n, nil
+		}
+		// 超出 int64 范围的无符号整数
+		return strconv.ParseUint(string(raw), 10, 64)
+	case typeName == "DECIMAL" || typeName == "NUMERIC" || strings.HasPrefix(typeName, "FLOAT") || typeName == "DOUBLE":
+		return strconv.ParseFloat(string(raw), 64)
+	default:
+		return string(raw), nil
+	}
+}
@@ -0,0 +1,102 @@
+package dao
+
+import (
+	"database/sql"
+	"time"
+)
+
+// 无法同步的阶段
+const (
+	StageFetch   = "fetch"   // 读取源数据, 如文件中无法解析的行、无法识别的主键
+	StageConvert = "convert" // 按字段映射转换
+	StageUpload  = "upload"  // 写入飞书, 被飞书拒绝
+	StagePull    = "pull"    // 写回源数据库, 飞书中修改的值无法转换, 保存飞书记录的字段
+)
+
+// DeadLetter 一条无法同步的源数据, 跳过后等待修复后重试或丢弃
+type DeadLetter struct {
+	Id          int64
+	Job         string
+	SourceTable string
+	SourceId    string
+	Stage       string
+	Row         string // 源数据, 以 JSON 保存; 文件中无法解析的行保存原文
+	Error       string
+	Attempts    int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// EnsureDeadLetterTable 确保 dead_letters 表存在, 同一任务的同一条源数据只保存一条
+func EnsureDeadLetterTable(db *sql.DB) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS dead_letters (
+			id INTEGER PRIMARY KEY,
+			job TEXT,
+			source_table TEXT,
+			source_id TEXT,
+			stage TEXT,
+			row TEXT,
+			error TEXT,
+			attempts INTEGER DEFAULT 1,
+			created_at DATETIME,
+			updated_at DATETIME,
+			UNIQUE(job, source_table, source_id)
+		)`
+	_, err := db.Exec(query)
+	return err
+}
+
+// SaveDeadLetter 保存一条无法同步的源数据, 已存在时更新阶段、内容和错误, 并将尝试次数加一
+func SaveDeadLetter(db *sql.DB, letter DeadLetter) error {
+	if err := EnsureDeadLetterTable(db); err != nil {
+		return err
+	}
+	now := time.Now()
+	query := `INSERT INTO dead_letters (job, source_table, source_id, stage, row, error, attempts, created_at, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?)
+			  ON CONFLICT(job, source_table, source_id) DO UPDATE SET stage=excluded.stage, row=excluded.row,
+			  error=excluded.error, attempts=dead_letters.attempts+1, updated_at=excluded.updated_at`
+	_, err := db.Exec(query, letter.Job, letter.SourceTable, letter.SourceId, letter.Stage, letter.Row, letter.Error, now, now)
+	return err
+}
+
+// ListDeadLetters 按保存顺序列出一个任务的全部无法同步的源数据
+func ListDeadLetters(db *sql.DB, job string) ([]DeadLetter, error) {
+	if err := EnsureDeadLetterTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT id, job, source_table, source_id, stage, row, error, attempts, created_at, updated_at
+						   FROM dead_letters WHERE job = ? ORDER BY id`, job)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		var letter DeadLetter
+		err := rows.Scan(&letter.Id, &letter.Job, &letter.SourceTable, &letter.SourceId, &letter.Stage, &letter.Row,
+			&letter.Error, &letter.Attempts, &letter.CreatedAt, &letter.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+// DeleteDeadLetters 删除指定的无法同步的源数据
+func DeleteDeadLetters(db *sql.DB, ids []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec(`DELETE FROM dead_letters WHERE id = ?`, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
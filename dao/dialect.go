@@ -0,0 +1,142 @@
+package dao
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dialect 源数据库的 SQL 方言, 生成查询时用于引用标识符、占位符和限制行数
+type Dialect interface {
+	// Quote 引用表名或字段名, 支持 schema.table 形式; 不是普通标识符(例如表达式)时原样返回
+	Quote(name string) string
+	// Placeholder 第 n 个参数的占位符, n 从 1 开始
+	Placeholder(n int) string
+	// Limit 限制行数的子句, 追加在 ORDER BY 之后, 行数以 ? 传入
+	Limit() string
+	// TextTime 时间是否以文本保存并按字符串比较. 为 true 时驱动返回的 time.Time 无法还原保存的原文,
+	// 按 time.Time 绑定的参数与原文格式不同时比较结果错误
+	TextTime() bool
+}
+
+// GetDialect 按驱动名返回 SQL 方言, 未知驱动使用标准 SQL
+func GetDialect(driver string) Dialect {
+	switch driver {
+	case "mysql":
+		return mysqlDialect{}
+	case "postgres", "pgx":
+		return postgresDialect{}
+	case "sqlite3":
+		return sqliteDialect{}
+	default:
+		return standardDialect{}
+	}
+}
+
+// Rebind 将查询中的 ? 占位符转换为方言的格式, 字符串和带引号的标识符中的 ? 保持不变
+func Rebind(dialect Dialect, query string) string {
+	if !strings.Contains(query, "?") || dialect.Placeholder(1) == "?" {
+		return query
+	}
+
+	var sb strings.Builder
+	n := 0
+	var quote rune
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '?':
+			n++
+			sb.WriteString(dialect.Placeholder(n))
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// quoteName 用 open 和 close 引用 name 的每一段
+func quoteName(name string, open string, close string) string {
+	parts := strings.Split(name, ".")
+	for _, part := range parts {
+		if !identifierPattern.MatchString(part) {
+			return name
+		}
+	}
+	for i, part := range parts {
+		parts[i] = open + part + close
+	}
+	return strings.Join(parts, ".")
+}
+
+// standardDialect 标准 SQL
+type standardDialect struct{}
+
+func (standardDialect) Quote(name string) string { return quoteName(name, `"`, `"`) }
+func (standardDialect) Placeholder(int) string   { return "?" }
+func (standardDialect) Limit() string            { return "LIMIT ?" }
+func (standardDialect) TextTime() bool           { return false }
+
+// sqliteDialect 与标准 SQL 相同, 时间以文本保存
+type sqliteDialect struct {
+	standardDialect
+}
+
+func (sqliteDialect) TextTime() bool { return true }
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Quote(name string) string { return quoteName(name, "`", "`") }
+func (mysqlDialect) Placeholder(int) string   { return "?" }
+func (mysqlDialect) Limit() string            { return "LIMIT ?" }
+func (mysqlDialect) TextTime() bool           { return false }
+
+type postgresDialect struct{}
+
+// postgresReserved PostgreSQL 的保留字, 作为表名或字段名时必须引用
+var postgresReserved = map[string]bool{
+	"all": true, "analyse": true, "analyze": true, "and": true, "any": true, "array": true, "as": true, "asc": true,
+	"asymmetric": true, "authorization": true, "binary": true, "both": true, "case": true, "cast": true, "check": true,
+	"collate": true, "collation": true, "column": true, "concurrently": true, "constraint": true, "create": true,
+	"cross": true, "current_catalog": true, "current_date": true, "current_role": true, "current_schema": true,
+	"current_time": true, "current_timestamp": true, "current_user": true, "default": true, "deferrable": true,
+	"desc": true, "distinct": true, "do": true, "else": true, "end": true, "except": true, "false": true, "fetch": true,
+	"for": true, "foreign": true, "freeze": true, "from": true, "full": true, "grant": true, "group": true,
+	"having": true, "ilike": true, "in": true, "initially": true, "inner": true, "intersect": true, "into": true,
+	"is": true, "isnull": true, "join": true, "lateral": true, "leading": true, "left": true, "like": true,
+	"limit": true, "localtime": true, "localtimestamp": true, "natural": true, "not": true, "notnull": true,
+	"null": true, "offset": true, "on": true, "only": true, "or": true, "order": true, "outer": true,
+	"overlaps": true, "placing": true, "primary": true, "references": true, "returning": true, "right": true,
+	"select": true, "session_user": true, "similar": true, "some": true, "symmetric": true, "system_user": true,
+	"table": true, "tablesample": true, "then": true, "to": true, "trailing": true, "true": true, "union": true,
+	"unique": true, "user": true, "using": true, "variadic": true, "verbose": true, "when": true, "where": true,
+	"window": true, "with": true,
+}
+
+// Quote 只引用保留字, 并按 PostgreSQL 的规则转换为小写, 其他名称不引用, 与直接写在 SQL 中一样不区分大小写.
+// 大小写敏感的名称需要在配置中自行加上双引号
+func (postgresDialect) Quote(name string) string {
+	parts := strings.Split(name, ".")
+	for _, part := range parts {
+		if !identifierPattern.MatchString(part) {
+			return name
+		}
+	}
+	for i, part := range parts {
+		if lower := strings.ToLower(part); postgresReserved[lower] {
+			parts[i] = `"` + lower + `"`
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func (postgresDialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+func (postgresDialect) Limit() string            { return "LIMIT ?" }
+func (postgresDialect) TextTime() bool           { return false }
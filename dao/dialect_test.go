@@ -0,0 +1,25 @@
+package dao
+
+import "testing"
+
+func TestPostgresQuote(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"status", "status"},
+		// 不引用时 PostgreSQL 按小写处理, 与配置中的大小写无关
+		{"UserName", "UserName"},
+		{"public.feedback", "public.feedback"},
+		{"user", `"user"`},
+		{"Order", `"order"`},
+		{"public.user", `public."user"`},
+		{`"UserName"`, `"UserName"`},
+		{"count(*)", "count(*)"},
+	}
+	for _, tt := range tests {
+		if got := (postgresDialect{}).Quote(tt.name); got != tt.want {
+			t.Errorf("Quote(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package dao
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Event 收到的多维表格记录变更事件
+type Event struct {
+	EventId   string
+	Job       string   // 事件所属的任务
+	RecordIds []string // 变更的飞书记录
+	Attempts  int      // 已处理失败的次数
+}
+
+// EnsureEventTable 确保 events 表存在, 事件按 (event_id, job) 去重, 同一个事件可以属于多个任务,
+// processed_at 为空表示尚未处理
+func EnsureEventTable(db *sql.DB) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS events (
+			event_id TEXT,
+			job TEXT DEFAULT '',
+			record_ids TEXT,
+			received_at DATETIME,
+			processed_at DATETIME,
+			attempts INTEGER DEFAULT 0,
+			error TEXT,
+			PRIMARY KEY (event_id, job)
+		)`
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	if err := migrateEventTable(db); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_events_processed_at ON events (processed_at)`)
+	return err
+}
+
+// migrateEventTable 旧版本的 events 表以 event_id 为主键, 一个事件只能属于一个任务, 重建为以 (event_id, job) 为主键.
+// 旧版本的事件属于未命名的任务
+func migrateEventTable(db *sql.DB) error {
+	var definition string
+	if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'events'`).Scan(&definition); err != nil {
+		return err
+	}
+	if strings.Contains(definition, "PRIMARY KEY (event_id, job)") {
+		return nil
+	}
+	if err := AddColumnIfMissing(db, "events", "job", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		`ALTER TABLE events RENAME TO events_old`,
+		`DROP INDEX IF EXISTS idx_events_processed_at`,
+		`CREATE TABLE events (
+			event_id TEXT,
+			job TEXT DEFAULT '',
+			record_ids TEXT,
+			received_at DATETIME,
+			processed_at DATETIME,
+			attempts INTEGER DEFAULT 0,
+			error TEXT,
+			PRIMARY KEY (event_id, job)
+		)`,
+		`INSERT INTO events (event_id, job, record_ids, received_at, processed_at, attempts, error)
+		 SELECT event_id, COALESCE(job, ''), record_ids, received_at, processed_at, attempts, error FROM events_old`,
+		`DROP TABLE events_old`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SaveEvent 保存收到的事件, 同一个任务已经收到过同一个 event_id 时返回 false
+func SaveEvent(db *sql.DB, event Event) (bool, error) {
+	if err := EnsureEventTable(db); err != nil {
+		return false, err
+	}
+
+	result, err := db.Exec(`INSERT OR IGNORE INTO events (event_id, job, record_ids, received_at) VALUES (?, ?, ?, ?)`,
+		event.EventId, event.Job, strings.Join(event.RecordIds, ","), time.Now())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// PendingEvents 按收到的顺序读取任务 job 至多 limit 个尚未处理的事件
+func PendingEvents(db *sql.DB, job string, limit int) ([]Event, error) {
+	if err := EnsureEventTable(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT event_id, job, record_ids, attempts FROM events
+			  WHERE job = ? AND processed_at IS NULL ORDER BY received_at LIMIT ?`, job, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		var recordIds sql.NullString
+		if err := rows.Scan(&event.EventId, &event.Job, &recordIds, &event.Attempts); err != nil {
+			return nil, err
+		}
+		if recordIds.String != "" {
+			event.RecordIds = strings.Split(recordIds.String, ",")
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// FinishEvents 将事件标记为已处理
+func FinishEvents(db *sql.DB, events []Event) error {
+	return execEvents(db, `UPDATE events SET processed_at = ?, error = NULL WHERE event_id = ? AND job = ?`, events, time.Now())
+}
+
+// FailEvents 记录事件处理失败的原因, 事件保持未处理状态, 之后重试
+func FailEvents(db *sql.DB, events []Event, cause error) error {
+	return execEvents(db, `UPDATE events SET attempts = attempts + 1, error = ? WHERE event_id = ? AND job = ?`, events, cause.Error())
+}
+
+// SkipEvents 记录事件处理失败的原因并不再重试, 事件标记为已处理, error 不为空
+func SkipEvents(db *sql.DB, events []Event, cause error) error {
+	return execEvents(db, `UPDATE events SET attempts = attempts + 1, processed_at = ?, error = ? WHERE event_id = ? AND job = ?`,
+		events, time.Now(), cause.Error())
+}
+
+// execEvents 在同一个事务中对每个事件执行 query, values 为前面的参数, event_id 和 job 为最后两个参数
+func execEvents(db *sql.DB, query string, events []Event, values ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, event := range events {
+		args := append(append([]interface{}{}, values...), event.EventId, event.Job)
+		if _, err := stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
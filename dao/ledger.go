@@ -0,0 +1,208 @@
+package dao
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// LedgerEntry 源数据与多维表格记录的对应关系
+type LedgerEntry struct {
+	SourceTable string
+	SourceId    string
+	RecordId    string
+	ContentHash string // 写入飞书的字段内容的哈希
+	SyncedAt    time.Time
+	Archived    bool // 源数据已删除, 飞书记录已标记为归档
+	Snapshot    Snapshot
+}
+
+// Snapshot 上次同步后两边一致的写回字段的值, 以源字段名为键, 值为 nil 表示字段为空.
+// 用于判断写回字段是在哪一边被修改的, 没有记录的字段视为未知
+type Snapshot map[string]*string
+
+// parseSnapshot 解析 record_ledger 中保存的快照
+func parseSnapshot(value sql.NullString) (Snapshot, error) {
+	if value.String == "" {
+		return nil, nil
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal([]byte(value.String), &snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// formatSnapshot 将快照序列化后保存, 没有快照时保存为 NULL
+func formatSnapshot(snapshot Snapshot) (sql.NullString, error) {
+	if len(snapshot) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// EnsureLedgerTable 确保 record_ledger 表存在
+func EnsureLedgerTable(db *sql.DB) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS record_ledger (
+			source_table TEXT NOT NULL,
+			source_id TEXT NOT NULL,
+			record_id TEXT NOT NULL,
+			content_hash TEXT,
+			synced_at DATETIME,
+			PRIMARY KEY (source_table, source_id)
+		)`
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	if err := AddColumnIfMissing(db, "record_ledger", "archived", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := AddColumnIfMissing(db, "record_ledger", "snapshot", "TEXT"); err != nil {
+		return err
+	}
+
+	// 为 record_id 创建索引, 用于从飞书记录反查源数据
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_ledger_record_id ON record_ledger (record_id)`)
+	return err
+}
+
+// SaveLedgerEntries 在同一个事务中插入或更新对应关系
+func SaveLedgerEntries(db *sql.DB, entries []LedgerEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := SaveLedgerEntriesTx(tx, entries); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveLedgerEntriesTx 在调用方的事务中插入或更新对应关系, 出错时由调用方回滚
+func SaveLedgerEntriesTx(tx *sql.Tx, entries []LedgerEntry) error {
+	stmt, err := tx.Prepare(`
+		INSERT INTO record_ledger (source_table, source_id, record_id, content_hash, synced_at, snapshot)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(source_table, source_id) DO UPDATE SET
+			record_id=excluded.record_id, content_hash=excluded.content_hash, synced_at=excluded.synced_at,
+			snapshot=excluded.snapshot`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, entry := range entries {
+		snapshot, err := formatSnapshot(entry.Snapshot)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(entry.SourceTable, entry.SourceId, entry.RecordId, entry.ContentHash, entry.SyncedAt, snapshot)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetLedgerEntry 查询源数据对应的飞书记录, 不存在时返回 sql.ErrNoRows
+func GetLedgerEntry(db *sql.DB, sourceTable string, sourceId string) (*LedgerEntry, error) {
+	entry := LedgerEntry{SourceTable: sourceTable, SourceId: sourceId}
+	var contentHash, snapshot sql.NullString
+	var syncedAt sql.NullTime
+	query := `SELECT record_id, content_hash, synced_at, archived, snapshot FROM record_ledger WHERE source_table = ? AND source_id = ?`
+	err := db.QueryRow(query, sourceTable, sourceId).Scan(&entry.RecordId, &contentHash, &syncedAt, &entry.Archived, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+	entry.ContentHash = contentHash.String
+	entry.SyncedAt = syncedAt.Time
+	if entry.Snapshot, err = parseSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// GetLedgerEntryByRecordId 按飞书记录查询对应的源数据, 不存在时返回 sql.ErrNoRows
+func GetLedgerEntryByRecordId(db *sql.DB, sourceTable string, recordId string) (*LedgerEntry, error) {
+	entry := LedgerEntry{SourceTable: sourceTable, RecordId: recordId}
+	var contentHash, snapshot sql.NullString
+	var syncedAt sql.NullTime
+	query := `SELECT source_id, content_hash, synced_at, archived, snapshot FROM record_ledger WHERE source_table = ? AND record_id = ?`
+	err := db.QueryRow(query, sourceTable, recordId).Scan(&entry.SourceId, &contentHash, &syncedAt, &entry.Archived, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+	entry.ContentHash = contentHash.String
+	entry.SyncedAt = syncedAt.Time
+	if entry.Snapshot, err = parseSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ListLedgerEntries 按 source_id 分页读取对应关系, 返回 source_id 大于 afterId 的至多 limit 条
+func ListLedgerEntries(db *sql.DB, sourceTable string, afterId string, limit int) ([]LedgerEntry, error) {
+	query := `SELECT source_id, record_id, content_hash, synced_at, archived, snapshot FROM record_ledger
+			  WHERE source_table = ? AND source_id > ? ORDER BY source_id LIMIT ?`
+	rows, err := db.Query(query, sourceTable, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		entry := LedgerEntry{SourceTable: sourceTable}
+		var contentHash, snapshot sql.NullString
+		var syncedAt sql.NullTime
+		if err := rows.Scan(&entry.SourceId, &entry.RecordId, &contentHash, &syncedAt, &entry.Archived, &snapshot); err != nil {
+			return nil, err
+		}
+		entry.ContentHash = contentHash.String
+		entry.SyncedAt = syncedAt.Time
+		if entry.Snapshot, err = parseSnapshot(snapshot); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteLedgerEntries 删除对应关系
+func DeleteLedgerEntries(db *sql.DB, entries []LedgerEntry) error {
+	return execLedgerEntries(db, `DELETE FROM record_ledger WHERE source_table = ? AND source_id = ?`, entries)
+}
+
+// ArchiveLedgerEntries 将对应关系标记为已归档
+func ArchiveLedgerEntries(db *sql.DB, entries []LedgerEntry) error {
+	return execLedgerEntries(db, `UPDATE record_ledger SET archived = 1 WHERE source_table = ? AND source_id = ?`, entries)
+}
+
+// execLedgerEntries 在同一个事务中对每条对应关系执行 query
+func execLedgerEntries(db *sql.DB, query string, entries []LedgerEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, entry := range entries {
+		if _, err := stmt.Exec(entry.SourceTable, entry.SourceId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,86 @@
+package dao
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Lease 一个运行锁的持有者
+type Lease struct {
+	Name      string
+	Owner     string // 持有者标识, 每个进程不同
+	Pid       int
+	Host      string
+	ExpiresAt time.Time
+}
+
+// EnsureLockTable 确保 locks 表存在, 过期时间以毫秒时间戳保存, 便于比较
+func EnsureLockTable(db *sql.DB) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS locks (
+			name TEXT PRIMARY KEY,
+			owner TEXT,
+			pid INTEGER,
+			host TEXT,
+			acquired_at DATETIME,
+			expires_at INTEGER
+		)`
+	_, err := db.Exec(query)
+	return err
+}
+
+// AcquireLease 获取名为 lease.Name 的锁, 锁不存在或已过期时获取成功; 锁未过期时返回当前的持有者和 false
+func AcquireLease(db *sql.DB, lease Lease) (*Lease, bool, error) {
+	return upsertLease(db, lease, `locks.expires_at < ?`, time.Now().UnixMilli())
+}
+
+// TakeoverLease 从 previous 手中接管锁, 用于持有锁的进程已经退出的情况; 锁已被其他进程接管时返回 false
+func TakeoverLease(db *sql.DB, lease Lease, previous string) (*Lease, bool, error) {
+	return upsertLease(db, lease, `locks.owner = ?`, previous)
+}
+
+// upsertLease 在满足 condition 时写入锁, 否则返回当前的持有者
+func upsertLease(db *sql.DB, lease Lease, condition string, args ...interface{}) (*Lease, bool, error) {
+	if err := EnsureLockTable(db); err != nil {
+		return nil, false, err
+	}
+
+	query := `INSERT INTO locks (name, owner, pid, host, acquired_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+			  ON CONFLICT(name) DO UPDATE SET owner=excluded.owner, pid=excluded.pid, host=excluded.host,
+			  acquired_at=excluded.acquired_at, expires_at=excluded.expires_at WHERE ` + condition
+	args = append([]interface{}{lease.Name, lease.Owner, lease.Pid, lease.Host, time.Now(), lease.ExpiresAt.UnixMilli()}, args...)
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n > 0 {
+		return nil, n > 0, err
+	}
+
+	holder := Lease{Name: lease.Name}
+	var expiresAt int64
+	err = db.QueryRow(`SELECT owner, pid, host, expires_at FROM locks WHERE name = ?`, lease.Name).
+		Scan(&holder.Owner, &holder.Pid, &holder.Host, &expiresAt)
+	if err != nil {
+		return nil, false, err
+	}
+	holder.ExpiresAt = time.UnixMilli(expiresAt)
+	return &holder, false, nil
+}
+
+// RenewLease 延长锁的过期时间, 锁已不属于 owner 时返回 false
+func RenewLease(db *sql.DB, name string, owner string, expiresAt time.Time) (bool, error) {
+	result, err := db.Exec(`UPDATE locks SET expires_at = ? WHERE name = ? AND owner = ?`, expiresAt.UnixMilli(), name, owner)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseLease 释放 owner 持有的锁
+func ReleaseLease(db *sql.DB, name string, owner string) error {
+	_, err := db.Exec(`DELETE FROM locks WHERE name = ? AND owner = ?`, name, owner)
+	return err
+}
@@ -0,0 +1,123 @@
+package dao
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// jobKeyPattern 属于命名任务的进度键和对应关系的源表名以任务名和 / 开头
+var jobKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+/`)
+
+// MigrateLegacyJob 将升级为多任务配置前未命名任务的本地状态迁移到任务 job: 同步进度、本地记录、对应关系、冲突、
+// 无法同步的数据和未处理的事件. 任务 job 已经有本地状态时无法合并, 返回错误
+func MigrateLegacyJob(db *sql.DB, job string) error {
+	if err := ensureJobTables(db); err != nil {
+		return err
+	}
+
+	legacy, err := legacyStateKeys(db)
+	if err != nil {
+		return err
+	}
+	var rows int
+	err = db.QueryRow(`SELECT
+			(SELECT COUNT(*) FROM records WHERE job = '' OR job IS NULL) +
+			(SELECT COUNT(*) FROM record_ledger WHERE source_table NOT LIKE '%/%') +
+			(SELECT COUNT(*) FROM dead_letters WHERE job = '' OR job IS NULL) +
+			(SELECT COUNT(*) FROM events WHERE job = '')`).Scan(&rows)
+	if err != nil {
+		return err
+	}
+	if len(legacy) == 0 && rows == 0 {
+		return nil
+	}
+
+	var existing int
+	prefix := job + "/"
+	err = db.QueryRow(`SELECT
+			(SELECT COUNT(*) FROM records WHERE job = ?) +
+			(SELECT COUNT(*) FROM state WHERE substr(key, 1, length(?)) = ?) +
+			(SELECT COUNT(*) FROM record_ledger WHERE substr(source_table, 1, length(?)) = ?)`,
+		job, prefix, prefix, prefix, prefix).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	if existing > 0 {
+		return fmt.Errorf("data.db has state of both the unnamed job and job %s, move the unnamed job's state manually or use a new data.db", job)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, key := range legacy {
+		if _, err := tx.Exec(`UPDATE state SET key = ? WHERE key = ?`, prefix+key, key); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	statements := []string{
+		`UPDATE records SET job = ? WHERE job = '' OR job IS NULL`,
+		`UPDATE record_ledger SET source_table = ? || '/' || source_table WHERE source_table NOT LIKE '%/%'`,
+		`UPDATE conflicts SET source_table = ? || '/' || source_table WHERE source_table NOT LIKE '%/%'`,
+		`UPDATE dead_letters SET job = ? WHERE job = '' OR job IS NULL`,
+		`UPDATE events SET job = ? WHERE job = ''`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, job); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("migrated state of the unnamed job to job %s", job)
+	return nil
+}
+
+// ensureJobTables 确保按任务区分的本地表存在, 旧版本创建的 records 表添加 job 字段
+func ensureJobTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS records (
+			id INTEGER PRIMARY KEY,
+			feed_id INTEGER,
+			flag INTEGER DEFAULT 0,
+			created_at DATETIME
+		)`)
+	if err != nil {
+		return err
+	}
+	if err := AddColumnIfMissing(db, "records", "job", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	for _, ensure := range []func(*sql.DB) error{EnsureStateTable, EnsureLedgerTable, EnsureConflictTable, EnsureDeadLetterTable, EnsureEventTable} {
+		if err := ensure(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyStateKeys 返回不属于任何命名任务的进度键
+func legacyStateKeys(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT key FROM state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if !jobKeyPattern.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, rows.Err()
+}
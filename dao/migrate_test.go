@@ -0,0 +1,74 @@
+package dao
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"testing"
+)
+
+// openLegacyDatabase 创建一个只有未命名任务状态的本地数据库
+func openLegacyDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := SetState(db, "watermark:feedback", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetState(db, "file:/data/feedback.csv", "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureLedgerTable(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveLedgerEntries(db, []LedgerEntry{{SourceTable: "feedback", SourceId: "1", RecordId: "rec1"}}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMigrateLegacyJob(t *testing.T) {
+	db := openLegacyDatabase(t)
+	if err := MigrateLegacyJob(db, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{
+		"watermark:feedback":        "",
+		"a/watermark:feedback":      "10",
+		"a/file:/data/feedback.csv": "{}",
+	} {
+		value, err := GetState(db, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != want {
+			t.Errorf("state %s = %q, want %q", key, value, want)
+		}
+	}
+	if _, err := GetLedgerEntry(db, "a/feedback", "1"); err != nil {
+		t.Errorf("ledger entry not migrated: %v", err)
+	}
+
+	// 再次启动时不重复迁移
+	if err := MigrateLegacyJob(db, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := GetState(db, "a/watermark:feedback"); value != "10" {
+		t.Errorf("state changed by a second migration: %q", value)
+	}
+}
+
+func TestMigrateLegacyJobConflict(t *testing.T) {
+	db := openLegacyDatabase(t)
+	if err := SetState(db, "a/watermark:feedback", "20"); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateLegacyJob(db, "a"); err == nil {
+		t.Fatal("migrated into a job that already has state")
+	}
+}
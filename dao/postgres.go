@@ -0,0 +1,23 @@
+package dao
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+	"net"
+	"net/url"
+	"ser163.cn/earthworm/config"
+	"strconv"
+)
+
+// ConnectPostgresDatabase 连接 PostgreSQL 数据库
+func ConnectPostgresDatabase(config *config.Config) (*sql.DB, error) {
+	postgres := config.Read.Postgres
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(postgres.Username, postgres.Password),
+		Host:     net.JoinHostPort(postgres.Host, strconv.Itoa(postgres.Port)),
+		Path:     "/" + postgres.Database,
+		RawQuery: url.Values{"sslmode": {postgres.SSLMode}}.Encode(),
+	}
+	return sql.Open("postgres", dsn.String())
+}
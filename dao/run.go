@@ -0,0 +1,38 @@
+package dao
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// RunResult 一次同步的结果, 以 JSON 保存在 state 表中
+type RunResult struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"` // 为空表示成功
+}
+
+// SaveRunResult 保存最近一次同步的结果
+func SaveRunResult(db *sql.DB, key string, result RunResult) error {
+	value, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return SetState(db, key, string(value))
+}
+
+// GetRunResult 读取最近一次同步的结果, 从未同步时返回 nil
+func GetRunResult(db *sql.DB, key string) (*RunResult, error) {
+	value, err := GetState(db, key)
+	if err != nil || value == "" {
+		return nil, err
+	}
+
+	var result RunResult
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		return nil, fmt.Errorf("invalid run result %q: %v", value, err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,47 @@
+package dao
+
+import (
+	"database/sql"
+	"time"
+)
+
+// EnsureStateTable 确保 state 表存在, 用于保存各类同步进度
+func EnsureStateTable(db *sql.DB) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS state (
+			key TEXT PRIMARY KEY,
+			value TEXT,
+			updated_at DATETIME
+		)`
+	_, err := db.Exec(query)
+	return err
+}
+
+// GetState 读取同步进度, 不存在时返回空字符串
+func GetState(db *sql.DB, key string) (string, error) {
+	if err := EnsureStateTable(db); err != nil {
+		return "", err
+	}
+
+	var value string
+	err := db.QueryRow(`SELECT value FROM state WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// SetState 保存同步进度
+func SetState(db *sql.DB, key string, value string) error {
+	if err := EnsureStateTable(db); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO state (key, value, updated_at) VALUES (?, ?, ?)
+			  ON CONFLICT(key) DO UPDATE SET value=excluded.value, updated_at=excluded.updated_at`
+	_, err := db.Exec(query, key, value, time.Now())
+	return err
+}
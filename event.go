@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"ser163.cn/earthworm/config"
+	"ser163.cn/earthworm/dao"
+	"ser163.cn/earthworm/feishu"
+	"ser163.cn/earthworm/read"
+	"ser163.cn/earthworm/write"
+	"time"
+)
+
+// 每次最多合并处理的事件数
+const eventBatch = 100
+
+// 处理失败的事件的重试间隔
+const eventRetryInterval = 30 * time.Second
+
+// eventJob 处理一个任务的飞书事件使用的客户端, 与主流程并发执行, 使用单独的实例
+type eventJob struct {
+	job          *job
+	readClient   *read.ReadLib
+	writeClient  *write.WriteLib
+	feishuClient *feishu.FeiShuLib
+}
+
+// newEventJob 为开启写回的任务创建处理事件的客户端
+func newEventJob(j *job) *eventJob {
+	return &eventJob{
+		job:          j,
+		readClient:   read.NewReadLib(j.conf, j.sourceDb, j.sqlLitedb),
+		writeClient:  write.NewWriteLib(j.conf, j.sourceDb, j.sqlLitedb),
+		feishuClient: feishu.NewFeiShuLib(j.conf, j.sqlLitedb),
+	}
+}
+
+// serveEvents 启动 HTTP 服务接收飞书的记录变更事件. 事件按数据表分给所有开启写回的任务, 按 event_id 去重后保存到 events 表,
+// 由后台逐批写回源数据库, 处理失败的事件定时重试
+func serveEvents(conf *config.Config, jobs []*job, sqlLitedb *sql.DB) error {
+	var eventJobs []*eventJob
+	for _, j := range jobs {
+		if !j.conf.Sync.Pull.Enabled {
+			continue
+		}
+		eventJob := newEventJob(j)
+		if err := eventJob.feishuClient.SubscribeRecordChanges(); err != nil {
+			return err
+		}
+		eventJobs = append(eventJobs, eventJob)
+	}
+
+	notify := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(eventRetryInterval)
+		defer ticker.Stop()
+		for {
+			for _, j := range eventJobs {
+				if err := j.applyEvents(); err != nil {
+					log.Printf("Error applying events of job %s: %v", jobLabel(j.job.conf), err)
+				}
+			}
+			select {
+			case <-notify:
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	handler := eventJobs[0].feishuClient.EventHandler(receiveEvent(eventJobs, sqlLitedb, notify))
+	http.HandleFunc(conf.FeiShu.Event.Path, handler)
+	log.Printf("listening on %s%s", conf.FeiShu.Event.Addr, conf.FeiShu.Event.Path)
+	return http.ListenAndServe(conf.FeiShu.Event.Addr, nil)
+}
+
+// receiveEvent 将事件保存给同一个数据表的所有任务, 有新事件时通知后台处理
+func receiveEvent(eventJobs []*eventJob, sqlLitedb *sql.DB, notify chan<- struct{}) func(eventId string, baseId string, tableId string, recordIds []string) error {
+	return func(eventId string, baseId string, tableId string, recordIds []string) error {
+		received := false
+		for _, j := range eventJobs {
+			conf := j.job.conf
+			if conf.FeiShu.Drive.BaseId != baseId || conf.FeiShu.Drive.TableId != tableId {
+				continue
+			}
+			saved, err := dao.SaveEvent(sqlLitedb, dao.Event{EventId: eventId, Job: conf.Job, RecordIds: recordIds})
+			if err != nil {
+				return err
+			}
+			if !saved {
+				log.Printf("event %s already received by job %s", eventId, jobLabel(conf))
+				continue
+			}
+			received = true
+		}
+		if received {
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	}
+}
+
+// applyEvents 逐批处理任务未处理的事件, 查询事件中的记录并写回源数据库, 直到没有未处理的事件.
+// 任务正在同步时跳过, 由之后重试; 一批事件处理失败时逐个重试, 失败次数达到 feishu.event.max_attempts 的事件不再重试
+func (j *eventJob) applyEvents() error {
+	unlock, ok := j.job.tryLock()
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	conf := j.job.conf
+	sqlLitedb := j.job.sqlLitedb
+	for {
+		events, err := dao.PendingEvents(sqlLitedb, conf.Job, eventBatch)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		err = j.apply(events)
+		if err == nil {
+			if err := dao.FinishEvents(sqlLitedb, events); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(events) == 1 {
+			skipped, ferr := j.fail(events[0], err)
+			if ferr != nil {
+				return ferr
+			}
+			if !skipped {
+				return err
+			}
+			continue
+		}
+
+		// 找出无法处理的事件, 其他事件不受影响
+		retry := 0
+		for _, event := range events {
+			if err := j.apply([]dao.Event{event}); err != nil {
+				skipped, ferr := j.fail(event, err)
+				if ferr != nil {
+					return ferr
+				}
+				if !skipped {
+					retry++
+				}
+				continue
+			}
+			if err := dao.FinishEvents(sqlLitedb, []dao.Event{event}); err != nil {
+				return err
+			}
+		}
+		// 全部失败时通常是接口或数据库不可用, 等待下次重试
+		if retry == len(events) {
+			return err
+		}
+	}
+}
+
+// apply 查询一批事件中的记录并写回源数据库
+func (j *eventJob) apply(events []dao.Event) error {
+	var recordIds []string
+	seen := make(map[string]bool)
+	for _, event := range events {
+		for _, recordId := range event.RecordIds {
+			if !seen[recordId] {
+				seen[recordId] = true
+				recordIds = append(recordIds, recordId)
+			}
+		}
+	}
+
+	records, err := j.feishuClient.BatchGetRecords(recordIds)
+	if err != nil {
+		return err
+	}
+	return applyPulled(j.feishuClient, j.readClient, j.writeClient, j.job.sqlLitedb, records)
+}
+
+// fail 记录事件处理失败, 达到最多次数时标记为已处理并保留错误, 不再重试, 此时返回 true
+func (j *eventJob) fail(event dao.Event, cause error) (bool, error) {
+	sqlLitedb := j.job.sqlLitedb
+	if event.Attempts+1 < j.job.conf.FeiShu.Event.MaxAttempts {
+		return false, dao.FailEvents(sqlLitedb, []dao.Event{event}, cause)
+	}
+	log.Printf("skipping event %s of job %s after %d attempts: %v", event.EventId, jobLabel(j.job.conf), event.Attempts+1, cause)
+	return true, dao.SkipEvents(sqlLitedb, []dao.Event{event}, fmt.Errorf("skipped after %d attempts: %v", event.Attempts+1, cause))
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/larksuite/oapi-sdk-go/v3"
+	"github.com/larksuite/oapi-sdk-go/v3/event"
+	_ "github.com/mattn/go-sqlite3"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"ser163.cn/earthworm/config"
+	"ser163.cn/earthworm/dao"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testBaseId            = "base"
+	testTableId           = "tbl"
+	testVerificationToken = "vt"
+	testEncryptKey        = "ek"
+)
+
+// fakeBitable 模拟飞书获取 token 和查询、批量获取、批量新建、批量更新、批量删除记录的接口
+type fakeBitable struct {
+	mu          sync.Mutex
+	records     map[string]map[string]interface{} // 以 record_id 为键的字段值
+	updates     int                               // 收到的批量更新请求数
+	requests    []fakeRequest                     // 收到的记录接口请求
+	createError *fakeError                        // 不为 nil 时新建记录返回该错误
+}
+
+// fakeError 接口返回的错误
+type fakeError struct {
+	Status int
+	Code   int
+}
+
+// fakeRequest 记录接口收到的一个请求
+type fakeRequest struct {
+	Action string // 接口路径的最后一段, 例如 batch_update
+	Body   string
+}
+
+func (f *fakeBitable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/open-apis/auth/v3/tenant_access_token/internal" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"code": 0, "tenant_access_token": "t", "expire": 7200})
+		return
+	}
+
+	prefix := "/open-apis/bitable/v1/apps/" + testBaseId + "/tables/" + testTableId + "/records/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	raw, _ := io.ReadAll(r.Body)
+	action := strings.TrimPrefix(r.URL.Path, prefix)
+	f.requests = append(f.requests, fakeRequest{Action: action, Body: string(raw)})
+	var body struct {
+		RecordIds []string        `json:"record_ids"`
+		Records   json.RawMessage `json:"records"`
+	}
+	json.Unmarshal(raw, &body)
+
+	data := map[string]interface{}{}
+	switch action {
+	case "batch_create":
+		if f.createError != nil {
+			w.WriteHeader(f.createError.Status)
+			json.NewEncoder(w).Encode(map[string]interface{}{"code": f.createError.Code, "msg": "error"})
+			return
+		}
+		var created []map[string]interface{}
+		json.Unmarshal(body.Records, &created)
+		for i, record := range created {
+			record["record_id"] = fmt.Sprintf("new%d", len(f.requests)*1000+i)
+		}
+		data["records"] = created
+	case "batch_get":
+		var records []map[string]interface{}
+		for _, recordId := range body.RecordIds {
+			if fields, ok := f.records[recordId]; ok {
+				records = append(records, map[string]interface{}{
+					"record_id":          recordId,
+					"fields":             fields,
+					"last_modified_time": time.Now().UnixMilli(),
+				})
+			}
+		}
+		data["records"] = records
+	case "batch_update":
+		f.updates++
+	case "batch_delete":
+		var recordIds []string
+		json.Unmarshal(body.Records, &recordIds)
+		var records []map[string]interface{}
+		for _, recordId := range recordIds {
+			records = append(records, map[string]interface{}{"record_id": recordId, "deleted": true})
+		}
+		data["records"] = records
+	case "search":
+		var items []map[string]interface{}
+		for recordId, fields := range f.records {
+			items = append(items, map[string]interface{}{
+				"record_id":          recordId,
+				"fields":             fields,
+				"last_modified_time": time.Now().UnixMilli(),
+			})
+		}
+		data["items"] = items
+		data["has_more"] = false
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": 0, "msg": "ok", "data": data})
+}
+
+// lastRequest 返回最后一个记录接口请求
+func (f *fakeBitable) lastRequest() fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return fakeRequest{}
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// eventTestConfig 写回 feedback 表状态字段的任务配置
+func eventTestConfig(name string) *config.Config {
+	conf := &config.Config{Job: name}
+	conf.Read.Driver = "sqlite3"
+	conf.Read.Source.Table = "feedback"
+	conf.Read.Source.IdColumn = "id"
+	conf.Read.Mode.Rows = 100
+	conf.Mapping = []config.Field{{Field: "状态", Column: "status"}}
+	conf.Sync.Pull.Enabled = true
+	conf.Sync.Pull.Fields = []config.Field{{Field: "状态", Column: "status"}}
+	conf.Sync.Conflict.Default = config.ConflictManual
+	conf.FeiShu.Drive.BaseId = testBaseId
+	conf.FeiShu.Drive.TableId = testTableId
+	conf.FeiShu.Batch.Size = 100
+	conf.FeiShu.Retry.Attempts = 1
+	conf.FeiShu.Event.VerificationToken = testVerificationToken
+	conf.FeiShu.Event.EncryptKey = testEncryptKey
+	conf.FeiShu.Event.MaxAttempts = 2
+	return conf
+}
+
+// newEventTest 创建共用源表 feedback 的任务 a 和 b, 飞书接口由 fake 模拟.
+// 源表中有一条 status 为 open 的数据, 已同步为记录 rec1
+func newEventTest(t *testing.T, fake *fakeBitable) ([]*eventJob, *sql.DB, *sql.DB) {
+	t.Helper()
+	dir := t.TempDir()
+	state, err := sql.Open("sqlite3", filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := sql.Open("sqlite3", filepath.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(func() {
+		srv.Close()
+		state.Close()
+		source.Close()
+	})
+
+	if _, err := source.Exec(`CREATE TABLE feedback (id INTEGER PRIMARY KEY, status TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Exec(`INSERT INTO feedback (id, status) VALUES (1, 'open')`); err != nil {
+		t.Fatal(err)
+	}
+	// 有效的 tenant_access_token, 不请求获取 token 的接口
+	if _, err := state.Exec(`CREATE TABLE tokens (id INTEGER PRIMARY KEY, token TEXT, expires_at DATETIME)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.Exec(`INSERT INTO tokens (id, token, expires_at) VALUES (1, 't', ?)`, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dao.EnsureLedgerTable(state); err != nil {
+		t.Fatal(err)
+	}
+
+	var eventJobs []*eventJob
+	for _, name := range []string{"a", "b"} {
+		conf := eventTestConfig(name)
+		open := "open"
+		err := dao.SaveLedgerEntries(state, []dao.LedgerEntry{{
+			SourceTable: conf.LedgerTable(),
+			SourceId:    "1",
+			RecordId:    "rec1",
+			SyncedAt:    time.Now(),
+			Snapshot:    dao.Snapshot{"status": &open},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := newEventJob(newJob(conf, state, source))
+		j.feishuClient.Client = lark.NewClient("id", "secret", lark.WithOpenBaseUrl(srv.URL))
+		j.job.feishuClient.Client = j.feishuClient.Client
+		eventJobs = append(eventJobs, j)
+	}
+	return eventJobs, state, source
+}
+
+// encryptEvent 按飞书的方式加密事件并签名, 返回请求
+func encryptEvent(t *testing.T, payload string) *http.Request {
+	t.Helper()
+	key := sha256.Sum256([]byte(testEncryptKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(payload)
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	plain = append(plain, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	buf := make([]byte, aes.BlockSize+len(plain))
+	copy(buf, "0123456789abcdef")
+	cipher.NewCBCEncrypter(block, buf[:aes.BlockSize]).CryptBlocks(buf[aes.BlockSize:], plain)
+
+	body, err := json.Marshal(map[string]string{"encrypt": base64.StdEncoding.EncodeToString(buf)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signedRequest(string(body))
+}
+
+// signedRequest 创建带有正确签名的请求
+func signedRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/webhook/event", strings.NewReader(body))
+	timestamp, nonce := "1700000000", "nonce"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Lark-Request-Timestamp", timestamp)
+	req.Header.Set("X-Lark-Request-Nonce", nonce)
+	req.Header.Set("X-Lark-Signature", larkevent.Signature(timestamp, nonce, testEncryptKey, body))
+	return req
+}
+
+// recordChanged 记录 recordId 被修改的事件
+func recordChanged(eventId string, recordId string) string {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"schema": "2.0",
+		"header": map[string]interface{}{
+			"event_id":   eventId,
+			"token":      testVerificationToken,
+			"event_type": "drive.file.bitable_record_changed_v1",
+			"app_id":     "id",
+		},
+		"event": map[string]interface{}{
+			"file_token": testBaseId,
+			"table_id":   testTableId,
+			"action_list": []map[string]interface{}{
+				{"record_id": recordId, "action": "record_edited"},
+			},
+		},
+	})
+	return string(payload)
+}
+
+// serve 由第一个任务的 EventHandler 处理请求, 返回响应
+func serve(eventJobs []*eventJob, state *sql.DB, req *http.Request) *httptest.ResponseRecorder {
+	handler := eventJobs[0].feishuClient.EventHandler(receiveEvent(eventJobs, state, make(chan struct{}, 1)))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// countEvents 统计任务 job 保存的事件数
+func countEvents(t *testing.T, state *sql.DB, job string) int {
+	t.Helper()
+	var n int
+	if err := state.QueryRow(`SELECT COUNT(*) FROM events WHERE job = ?`, job).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestEventRejected(t *testing.T) {
+	eventJobs, state, _ := newEventTest(t, &fakeBitable{})
+
+	// 签名不正确
+	req := encryptEvent(t, recordChanged("ev1", "rec1"))
+	req.Header.Set("X-Lark-Signature", "bad")
+	if w := serve(eventJobs, state, req); w.Code == http.StatusOK {
+		t.Errorf("bad signature: status %d, want an error", w.Code)
+	}
+
+	// 无法解密
+	if w := serve(eventJobs, state, signedRequest(`{"encrypt":"bm90IGVuY3J5cHRlZA=="}`)); w.Code == http.StatusOK {
+		t.Errorf("bad ciphertext: status %d, want an error", w.Code)
+	}
+
+	// token 不一致
+	payload := strings.Replace(recordChanged("ev2", "rec1"), testVerificationToken, "other", 1)
+	if w := serve(eventJobs, state, encryptEvent(t, payload)); w.Code == http.StatusOK {
+		t.Errorf("bad token: status %d, want an error", w.Code)
+	}
+
+	if err := dao.EnsureEventTable(state); err != nil {
+		t.Fatal(err)
+	}
+	if n := countEvents(t, state, "a"); n != 0 {
+		t.Errorf("saved %d rejected events", n)
+	}
+}
+
+func TestEventChallenge(t *testing.T) {
+	eventJobs, state, _ := newEventTest(t, &fakeBitable{})
+
+	payload := `{"type":"url_verification","challenge":"abc","token":"` + testVerificationToken + `"}`
+	w := serve(eventJobs, state, encryptEvent(t, payload))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Challenge != "abc" {
+		t.Errorf("response %s, want challenge abc", w.Body.String())
+	}
+}
+
+func TestEventDedupeAndApply(t *testing.T) {
+	fake := &fakeBitable{records: map[string]map[string]interface{}{
+		"rec1": {"状态": "closed"},
+	}}
+	eventJobs, state, source := newEventTest(t, fake)
+
+	// 同一个事件推送两次, 每个任务只保存一次
+	for i := 0; i < 2; i++ {
+		if w := serve(eventJobs, state, encryptEvent(t, recordChanged("ev1", "rec1"))); w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+	}
+	for _, job := range []string{"a", "b"} {
+		if n := countEvents(t, state, job); n != 1 {
+			t.Errorf("job %s saved %d events, want 1", job, n)
+		}
+	}
+
+	if err := eventJobs[0].applyEvents(); err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	if err := source.QueryRow(`SELECT status FROM feedback WHERE id = 1`).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != "closed" {
+		t.Errorf("status %q, want closed", status)
+	}
+	if fake.updates == 0 {
+		t.Error("written record was not synced back to the bitable")
+	}
+	events, err := dao.PendingEvents(state, "a", eventBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("job a has %d pending events after applying", len(events))
+	}
+	// 任务 b 的事件单独处理
+	events, err = dao.PendingEvents(state, "b", eventBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("job b has %d pending events, want 1", len(events))
+	}
+}
+
+func TestEventSkippedAfterMaxAttempts(t *testing.T) {
+	fake := &fakeBitable{records: map[string]map[string]interface{}{
+		"rec1": {"状态": "closed"},
+	}}
+	eventJobs, state, source := newEventTest(t, fake)
+	// 写回时源表不存在, 每次处理都失败
+	if _, err := source.Exec(`ALTER TABLE feedback RENAME TO feedback_old`); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(eventJobs, state, encryptEvent(t, recordChanged("ev1", "rec1"))); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	j := eventJobs[0]
+	if err := j.applyEvents(); err == nil {
+		t.Fatal("first attempt succeeded, want an error")
+	}
+	events, err := dao.PendingEvents(state, "a", eventBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Attempts != 1 {
+		t.Fatalf("pending events %+v, want one event with 1 attempt", events)
+	}
+
+	// 达到 max_attempts 后不再重试
+	if err := j.applyEvents(); err != nil {
+		t.Fatal(err)
+	}
+	events, err = dao.PendingEvents(state, "a", eventBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("event still pending after %d attempts", j.job.conf.FeiShu.Event.MaxAttempts)
+	}
+	var cause sql.NullString
+	if err := state.QueryRow(`SELECT error FROM events WHERE event_id = 'ev1' AND job = 'a'`).Scan(&cause); err != nil {
+		t.Fatal(err)
+	}
+	if !cause.Valid || cause.String == "" {
+		t.Error("skipped event lost its error")
+	}
+}
@@ -0,0 +1,138 @@
+package feishu
+
+import (
+	"context"
+	"errors"
+	"github.com/larksuite/oapi-sdk-go/v3/core"
+	"github.com/larksuite/oapi-sdk-go/v3/core/httpserverext"
+	"github.com/larksuite/oapi-sdk-go/v3/event"
+	"github.com/larksuite/oapi-sdk-go/v3/event/dispatcher"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	larkdrive "github.com/larksuite/oapi-sdk-go/v3/service/drive/v1"
+	"log"
+	"net/http"
+)
+
+// 批量获取记录接口单次最多查询的记录数
+const batchGetSize = 100
+
+// EventHandler 创建接收多维表格记录变更事件的 http.HandlerFunc.
+// 请求的签名校验、解密和 URL 验证由 SDK 处理, 事件中的 token 与 Verification Token 不一致时拒绝;
+// 只处理新增和修改的记录, 每个事件调用一次 handle,
+// 由 handle 按 baseId 和 tableId 判断事件属于哪个任务; handle 返回错误时响应失败, 飞书会重新推送该事件
+func (f *FeiShuLib) EventHandler(handle func(eventId string, baseId string, tableId string, recordIds []string) error) http.HandlerFunc {
+	conf := f.Setting.FeiShu.Event
+	eventDispatcher := dispatcher.NewEventDispatcher(conf.VerificationToken, conf.EncryptKey).
+		OnP2FileBitableRecordChangedV1(func(ctx context.Context, event *larkdrive.P2FileBitableRecordChangedV1) error {
+			if event.EventV2Base == nil || event.EventV2Base.Header == nil || event.Event == nil {
+				return nil
+			}
+			// 未设置 Encrypt Key 时 SDK 不校验签名, 只能按 token 判断事件是否来自飞书
+			if event.EventV2Base.Header.Token != conf.VerificationToken {
+				return errors.New("event token does not match the verification token")
+			}
+			data := event.Event
+			var recordIds []string
+			for _, action := range data.ActionList {
+				// 删除的记录不写回源数据库
+				if action.RecordId == nil || larkcore.StringValue(action.Action) == "record_deleted" {
+					continue
+				}
+				recordIds = append(recordIds, *action.RecordId)
+			}
+			if len(recordIds) == 0 {
+				return nil
+			}
+			return handle(event.EventV2Base.Header.EventID, larkcore.StringValue(data.FileToken), larkcore.StringValue(data.TableId), recordIds)
+		})
+	return httpserverext.NewEventHandlerFunc(eventDispatcher, larkevent.WithLogLevel(larkcore.LogLevelInfo))
+}
+
+// SubscribeRecordChanges 订阅多维表格的记录变更事件, 已订阅时不重复订阅
+func (f *FeiShuLib) SubscribeRecordChanges() error {
+	token, err := f.GetTenantAccessToken()
+	if err != nil {
+		return err
+	}
+	baseId := f.Setting.FeiShu.Drive.BaseId
+
+	getReq := larkdrive.NewGetSubscribeFileReqBuilder().
+		FileToken(baseId).
+		FileType("bitable").
+		Build()
+	var getResp *larkdrive.GetSubscribeFileResp
+	err = f.withRetry("get subscription", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		var err error
+		getResp, err = f.Client.Drive.File.GetSubscribe(context.Background(), getReq, larkcore.WithTenantAccessToken(token))
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return getResp.ApiResp, getResp.CodeError, nil
+	})
+	if err != nil {
+		return err
+	}
+	if getResp.Data != nil && larkcore.BoolValue(getResp.Data.IsSubseribe) {
+		return nil
+	}
+
+	req := larkdrive.NewSubscribeFileReqBuilder().
+		FileToken(baseId).
+		FileType("bitable").
+		Build()
+	err = f.withRetry("subscribe", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		resp, err := f.Client.Drive.File.Subscribe(context.Background(), req, larkcore.WithTenantAccessToken(token))
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return resp.ApiResp, resp.CodeError, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("subscribed to record changes of %s", baseId)
+	return nil
+}
+
+// BatchGetRecords 按 record_id 查询记录, 已删除或无权访问的记录不会返回
+func (f *FeiShuLib) BatchGetRecords(recordIds []string) ([]*larkbitable.AppTableRecord, error) {
+	token, err := f.GetTenantAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*larkbitable.AppTableRecord
+	for start := 0; start < len(recordIds); start += batchGetSize {
+		end := start + batchGetSize
+		if end > len(recordIds) {
+			end = len(recordIds)
+		}
+
+		req := larkbitable.NewBatchGetAppTableRecordReqBuilder().
+			AppToken(f.Setting.FeiShu.Drive.BaseId).
+			TableId(f.Setting.FeiShu.Drive.TableId).
+			Body(larkbitable.NewBatchGetAppTableRecordReqBodyBuilder().
+				RecordIds(recordIds[start:end]).
+				AutomaticFields(true).
+				Build()).
+			Build()
+
+		// 查询不修改数据, 可以安全重试
+		var resp *larkbitable.BatchGetAppTableRecordResp
+		err = f.withRetry("batch get records", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+			var err error
+			resp, err = f.Client.Bitable.AppTableRecord.BatchGet(context.Background(), req, larkcore.WithTenantAccessToken(token))
+			if err != nil {
+				return nil, larkcore.CodeError{}, err
+			}
+			return resp.ApiResp, resp.CodeError, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Data != nil {
+			records = append(records, resp.Data.Records...)
+		}
+	}
+	return records, nil
+}
@@ -9,9 +9,10 @@ import (
 	"github.com/larksuite/oapi-sdk-go/v3/core"
 	"github.com/larksuite/oapi-sdk-go/v3/service/auth/v3"
 	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
-	_ "log"
+	"log"
 	"net/http"
 	"ser163.cn/earthworm/config"
+	"ser163.cn/earthworm/utils"
 	"sync"
 	"time"
 )
@@ -21,6 +22,7 @@ type FeiShuLib struct {
 	Client   *lark.Client
 	Setting  *config.Config
 	Database *sql.DB
+	DryRun   bool       // 只输出新建、更新和删除记录的请求内容, 不发送
 	mu       sync.Mutex // 用于并发控制
 }
 
@@ -32,9 +34,8 @@ type TenantAccessTokenResponse struct {
 	Expire            float64 `json:"expire"` // 表示过期时间（秒）
 }
 
-// NewFeiShuLib 创建FeiShuLib实例
-func NewFeiShuLib(db *sql.DB) *FeiShuLib {
-	conf := config.GetConfig()
+// NewFeiShuLib 创建FeiShuLib实例, conf 为任务的配置
+func NewFeiShuLib(conf *config.Config, db *sql.DB) *FeiShuLib {
 	client := lark.NewClient(
 		conf.FeiShu.App.Id, conf.FeiShu.App.Secret,
 		lark.WithLogLevel(larkcore.LogLevelDebug),
@@ -88,7 +89,6 @@ func (f *FeiShuLib) GetTokenFromDB() (string, time.Time, error) {
 		return f.FetchAndSaveToken() // 如果 token 不再有效，调用 FetchAndSaveToken 获取新的 token
 	}
 
-	fmt.Println("Token fetched from cache")
 	return token, expiresAt, nil
 }
 
@@ -115,19 +115,20 @@ func (f *FeiShuLib) FetchAndSaveToken() (string, time.Time, error) {
 			Build()).
 		Build()
 
-	// 发起请求
-	resp, err := f.Client.Auth.TenantAccessToken.Internal(context.Background(), req)
+	// 发起请求, 获取 token 可以安全重试
+	var resp *larkauth.InternalTenantAccessTokenResp
+	err := f.withRetry("get token", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		var err error
+		resp, err = f.Client.Auth.TenantAccessToken.Internal(context.Background(), req)
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return resp.ApiResp, resp.CodeError, nil
+	})
 
 	// 处理错误
 	if err != nil {
-		fmt.Println(err)
-		return "", time.Time{}, fmt.Errorf("failed to get token: %v", resp.Msg)
-	}
-
-	// 服务端错误处理
-	if !resp.Success() {
-		fmt.Println(resp.Code, resp.Msg, resp.RequestId())
-		return "", time.Time{}, fmt.Errorf("failed to get token: %v", resp.Msg)
+		return "", time.Time{}, fmt.Errorf("failed to get token: %w", err)
 	}
 
 	// 解析响应
@@ -183,60 +184,287 @@ func (f *FeiShuLib) NewCreateRecord(record map[string]interface{}) (int, error)
 			Build()).
 		Build()
 
-	resp, err := f.Client.Bitable.V1.AppTableRecord.Create(context.Background(), req, larkcore.WithTenantAccessToken(token))
+	// 没有幂等键, 只在请求确定未被处理时重试
+	var resp *larkbitable.CreateAppTableRecordResp
+	err = f.withRetry("create record", false, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		var err error
+		resp, err = f.Client.Bitable.V1.AppTableRecord.Create(context.Background(), req, larkcore.WithTenantAccessToken(token))
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return resp.ApiResp, resp.CodeError, nil
+	})
 
 	// 处理错误
 	if err != nil {
-		fmt.Println(err)
 		return 1, err
 	}
 
-	// 服务端错误处理
-	if !resp.Success() {
-		// fmt.Println(resp.Code, resp.Msg, resp.RequestId())
-		return 1, err
+	log.Printf("created 1 record")
+	return 0, nil
+}
+
+// 批量新建记录, 按 Batch.Size 分批按顺序发送, 每批成功后调用 afterChunk(offset, created),
+// created 为飞书返回的该批记录, 顺序与请求一致.
+// keys 为与记录一一对应的源数据标识, 用于生成每批请求的 client_token,
+// 同一批源数据重复发送时由飞书去重; keys 为 nil 时不使用 client_token.
+// rejected 不为 nil 时, 被飞书拒绝的批改为逐条新建, 仍被拒绝的记录调用 rejected(index, err) 后跳过
+func (f *FeiShuLib) NewBatchCreateRecord(listRecord []*larkbitable.AppTableRecord, keys []string, afterChunk func(offset int, created []*larkbitable.AppTableRecord) error, rejected func(index int, err error) error) (int, error) {
+	if listRecord == nil {
+		return 0, nil // Fields is nil
 	}
 
-	// 业务处理
-	fmt.Println(larkcore.Prettify(resp))
+	size := f.Setting.FeiShu.Batch.Size
+	for offset := 0; offset < len(listRecord); offset += size {
+		end := offset + size
+		if end > len(listRecord) {
+			end = len(listRecord)
+		}
 
+		err := f.createChunk(listRecord, keys, offset, end, afterChunk)
+		if err != nil && rejected != nil && IsRejected(err) {
+			err = f.createEach(listRecord, keys, offset, end, afterChunk, rejected)
+		}
+		if err != nil {
+			return 1, err
+		}
+	}
 	return 0, nil
 }
 
-// 批量新建记录
-func (f *FeiShuLib) NewBatchCreateRecord(listRecord []*larkbitable.AppTableRecord) (int, error) {
-	if listRecord == nil {
-		return 0, nil // Fields is nil
+// createEach 逐条新建 [offset, end) 范围内的记录, 被飞书拒绝的记录交给 rejected 处理
+func (f *FeiShuLib) createEach(listRecord []*larkbitable.AppTableRecord, keys []string, offset int, end int, afterChunk func(offset int, created []*larkbitable.AppTableRecord) error, rejected func(index int, err error) error) error {
+	for i := offset; i < end; i++ {
+		err := f.createChunk(listRecord, keys, i, i+1, afterChunk)
+		if err != nil && IsRejected(err) {
+			err = rejected(i, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createChunk 新建 [offset, end) 范围内的记录, 成功后调用 afterChunk
+func (f *FeiShuLib) createChunk(listRecord []*larkbitable.AppTableRecord, keys []string, offset int, end int, afterChunk func(offset int, created []*larkbitable.AppTableRecord) error) error {
+	clientToken := ""
+	if keys != nil {
+		clientToken = f.clientToken(keys[offset:end])
+	}
+
+	created, err := f.batchCreate(listRecord[offset:end], clientToken)
+	if err != nil {
+		return err
+	}
+	// 只有飞书确认新建的记录才能推进本地记录
+	if len(created) != end-offset {
+		return fmt.Errorf("batch create returned %d records, expected %d", len(created), end-offset)
+	}
+	for i, record := range created {
+		if record == nil || record.RecordId == nil || *record.RecordId == "" {
+			return fmt.Errorf("batch create returned record %d without record_id", offset+i)
+		}
 	}
 
+	if afterChunk != nil {
+		return afterChunk(offset, created)
+	}
+	return nil
+}
+
+// clientToken 根据目标表和源数据标识生成固定的 client_token
+func (f *FeiShuLib) clientToken(keys []string) string {
+	parts := append([]string{f.Setting.FeiShu.Drive.BaseId, f.Setting.FeiShu.Drive.TableId}, keys...)
+	return utils.DeterministicUUID(parts...)
+}
+
+// batchCreate 调用一次批量新建接口, 返回新建的记录
+func (f *FeiShuLib) batchCreate(listRecord []*larkbitable.AppTableRecord, clientToken string) ([]*larkbitable.AppTableRecord, error) {
+	if f.DryRun {
+		return dryRunCreated(listRecord), f.printPayload("batch create", listRecord)
+	}
 	token, err := f.GetTenantAccessToken()
 	if err != nil {
-		return 1, err
+		return nil, err
 	}
 
 	// 创建请求对象
-	req := larkbitable.NewBatchCreateAppTableRecordReqBuilder().
+	builder := larkbitable.NewBatchCreateAppTableRecordReqBuilder().
 		AppToken(f.Setting.FeiShu.Drive.BaseId).
 		TableId(f.Setting.FeiShu.Drive.TableId).
 		Body(larkbitable.NewBatchCreateAppTableRecordReqBodyBuilder().
+			Records(listRecord).
+			Build())
+	if clientToken != "" {
+		builder.ClientToken(clientToken)
+	}
+	req := builder.Build()
+
+	// 带有 client_token 的请求由飞书去重, 可以安全重试; 否则只在请求确定未被处理时重试
+	var resp *larkbitable.BatchCreateAppTableRecordResp
+	err = f.withRetry("batch create records", clientToken != "", func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		var err error
+		resp, err = f.Client.Bitable.AppTableRecord.BatchCreate(context.Background(), req, larkcore.WithTenantAccessToken(token))
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return resp.ApiResp, resp.CodeError, nil
+	})
+
+	// 处理错误
+	if err != nil {
+		return nil, err
+	}
+	// withRetry 只在成功时返回 nil, 这里再确认一次, 避免没有写入任何记录时推进本地记录
+	if !resp.Success() || resp.Data == nil {
+		msg := resp.Msg
+		if resp.Success() {
+			msg = "response has no records"
+		}
+		return nil, &APIError{Op: "batch create records", Code: resp.Code, Msg: msg, RequestId: resp.RequestId(), StatusCode: resp.StatusCode}
+	}
+	log.Printf("created %d records", len(resp.Data.Records))
+	return resp.Data.Records, nil
+}
+
+// 批量更新记录, listRecord 需设置 RecordId. 按 Batch.Size 分批按顺序发送,
+// 每批成功后调用 afterChunk(offset, count)
+func (f *FeiShuLib) NewBatchUpdateRecord(listRecord []*larkbitable.AppTableRecord, afterChunk func(offset, count int) error) (int, error) {
+	size := f.Setting.FeiShu.Batch.Size
+	for offset := 0; offset < len(listRecord); offset += size {
+		end := offset + size
+		if end > len(listRecord) {
+			end = len(listRecord)
+		}
+
+		if err := f.batchUpdate(listRecord[offset:end]); err != nil {
+			return 1, err
+		}
+
+		if afterChunk != nil {
+			if err := afterChunk(offset, end-offset); err != nil {
+				return 1, err
+			}
+		}
+	}
+	return 0, nil
+}
+
+// batchUpdate 调用一次批量更新接口
+func (f *FeiShuLib) batchUpdate(listRecord []*larkbitable.AppTableRecord) error {
+	if f.DryRun {
+		return f.printPayload("batch update", listRecord)
+	}
+	token, err := f.GetTenantAccessToken()
+	if err != nil {
+		return err
+	}
+
+	// 创建请求对象
+	req := larkbitable.NewBatchUpdateAppTableRecordReqBuilder().
+		AppToken(f.Setting.FeiShu.Drive.BaseId).
+		TableId(f.Setting.FeiShu.Drive.TableId).
+		Body(larkbitable.NewBatchUpdateAppTableRecordReqBodyBuilder().
 			Records(listRecord).
 			Build()).
 		Build()
 
-	resp, err := f.Client.Bitable.AppTableRecord.BatchCreate(context.Background(), req, larkcore.WithTenantAccessToken(token))
+	// 更新为相同的内容, 可以安全重试
+	var resp *larkbitable.BatchUpdateAppTableRecordResp
+	err = f.withRetry("batch update records", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		var err error
+		resp, err = f.Client.Bitable.AppTableRecord.BatchUpdate(context.Background(), req, larkcore.WithTenantAccessToken(token))
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return resp.ApiResp, resp.CodeError, nil
+	})
 
 	// 处理错误
 	if err != nil {
-		fmt.Println(err)
-		return 1, err
+		return err
 	}
+	log.Printf("updated %d records", len(listRecord))
+	return nil
+}
 
-	// 服务端错误处理
-	if !resp.Success() {
-		fmt.Println(resp.Code, resp.Msg, resp.RequestId())
-		return 1, err
+// 批量删除记录, 按 Batch.Size 分批按顺序发送, 每批成功后调用 afterChunk(offset, count)
+func (f *FeiShuLib) NewBatchDeleteRecord(recordIds []string, afterChunk func(offset, count int) error) (int, error) {
+	size := f.Setting.FeiShu.Batch.Size
+	for offset := 0; offset < len(recordIds); offset += size {
+		end := offset + size
+		if end > len(recordIds) {
+			end = len(recordIds)
+		}
+
+		if err := f.batchDelete(recordIds[offset:end]); err != nil {
+			return 1, err
+		}
+
+		if afterChunk != nil {
+			if err := afterChunk(offset, end-offset); err != nil {
+				return 1, err
+			}
+		}
 	}
-	// 业务处理
-	fmt.Println(larkcore.Prettify(resp))
 	return 0, nil
 }
+
+// batchDelete 调用一次批量删除接口
+func (f *FeiShuLib) batchDelete(recordIds []string) error {
+	if f.DryRun {
+		return f.printPayload("batch delete", recordIds)
+	}
+	token, err := f.GetTenantAccessToken()
+	if err != nil {
+		return err
+	}
+
+	// 创建请求对象
+	req := larkbitable.NewBatchDeleteAppTableRecordReqBuilder().
+		AppToken(f.Setting.FeiShu.Drive.BaseId).
+		TableId(f.Setting.FeiShu.Drive.TableId).
+		Body(larkbitable.NewBatchDeleteAppTableRecordReqBodyBuilder().
+			Records(recordIds).
+			Build()).
+		Build()
+
+	// 删除相同的记录, 可以安全重试
+	var resp *larkbitable.BatchDeleteAppTableRecordResp
+	err = f.withRetry("batch delete records", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		var err error
+		resp, err = f.Client.Bitable.AppTableRecord.BatchDelete(context.Background(), req, larkcore.WithTenantAccessToken(token))
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return resp.ApiResp, resp.CodeError, nil
+	})
+
+	// 处理错误
+	if err != nil {
+		return err
+	}
+	log.Printf("deleted %d records", len(recordIds))
+	return nil
+}
+
+// printPayload 输出批量接口的请求内容, 用于只预览不发送的运行
+func (f *FeiShuLib) printPayload(name string, records interface{}) error {
+	body, err := json.MarshalIndent(map[string]interface{}{"records": records}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("dry run: %s %s/%s\n%s\n", name, f.Setting.FeiShu.Drive.BaseId, f.Setting.FeiShu.Drive.TableId, body)
+	return nil
+}
+
+// dryRunCreated 为只预览的新建请求生成对应的记录, record_id 只用于保存在临时的对应关系中
+func dryRunCreated(listRecord []*larkbitable.AppTableRecord) []*larkbitable.AppTableRecord {
+	created := make([]*larkbitable.AppTableRecord, len(listRecord))
+	for i, record := range listRecord {
+		recordId := fmt.Sprintf("dry-run-%d", i)
+		created[i] = &larkbitable.AppTableRecord{RecordId: &recordId, Fields: record.Fields}
+	}
+	return created
+}
@@ -0,0 +1,127 @@
+package feishu
+
+import (
+	"context"
+	"github.com/larksuite/oapi-sdk-go/v3/core"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+)
+
+// 列出字段接口单页最多返回的字段数
+const fieldPageSize = 100
+
+// ListFields 列出数据表的全部字段
+func (f *FeiShuLib) ListFields() ([]*larkbitable.AppTableFieldForList, error) {
+	token, err := f.GetTenantAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []*larkbitable.AppTableFieldForList
+	pageToken := ""
+	for {
+		builder := larkbitable.NewListAppTableFieldReqBuilder().
+			AppToken(f.Setting.FeiShu.Drive.BaseId).
+			TableId(f.Setting.FeiShu.Drive.TableId).
+			PageSize(fieldPageSize)
+		if pageToken != "" {
+			builder.PageToken(pageToken)
+		}
+		req := builder.Build()
+
+		// 查询不修改数据, 可以安全重试
+		var resp *larkbitable.ListAppTableFieldResp
+		err = f.withRetry("list fields", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+			var err error
+			resp, err = f.Client.Bitable.AppTableField.List(context.Background(), req, larkcore.WithTenantAccessToken(token))
+			if err != nil {
+				return nil, larkcore.CodeError{}, err
+			}
+			return resp.ApiResp, resp.CodeError, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Data == nil {
+			return fields, nil
+		}
+
+		fields = append(fields, resp.Data.Items...)
+		if !larkcore.BoolValue(resp.Data.HasMore) || resp.Data.PageToken == nil {
+			return fields, nil
+		}
+		pageToken = *resp.Data.PageToken
+	}
+}
+
+// CreateField 在数据表中新建字段, options 为单选、多选字段的选项
+func (f *FeiShuLib) CreateField(name string, fieldType int, options []string) error {
+	token, err := f.GetTenantAccessToken()
+	if err != nil {
+		return err
+	}
+
+	field := larkbitable.NewAppTableFieldBuilder().
+		FieldName(name).
+		Type(fieldType)
+	if len(options) > 0 {
+		field.Property(&larkbitable.AppTableFieldProperty{Options: newOptions(options)})
+	}
+	req := larkbitable.NewCreateAppTableFieldReqBuilder().
+		AppToken(f.Setting.FeiShu.Drive.BaseId).
+		TableId(f.Setting.FeiShu.Drive.TableId).
+		ClientToken(f.clientToken([]string{"field", name})).
+		AppTableField(field.Build()).
+		Build()
+
+	// 带有 client_token 的请求由飞书去重, 可以安全重试
+	return f.withRetry("create field", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		resp, err := f.Client.Bitable.AppTableField.Create(context.Background(), req, larkcore.WithTenantAccessToken(token))
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return resp.ApiResp, resp.CodeError, nil
+	})
+}
+
+// AddFieldOptions 为单选、多选字段追加选项, 保留字段原有的属性和选项
+func (f *FeiShuLib) AddFieldOptions(field *larkbitable.AppTableFieldForList, options []string) error {
+	token, err := f.GetTenantAccessToken()
+	if err != nil {
+		return err
+	}
+
+	property := &larkbitable.AppTableFieldProperty{}
+	if field.Property != nil {
+		copied := *field.Property
+		property = &copied
+	}
+	property.Options = append(append([]*larkbitable.AppTableFieldPropertyOption(nil), property.Options...), newOptions(options)...)
+	req := larkbitable.NewUpdateAppTableFieldReqBuilder().
+		AppToken(f.Setting.FeiShu.Drive.BaseId).
+		TableId(f.Setting.FeiShu.Drive.TableId).
+		FieldId(larkcore.StringValue(field.FieldId)).
+		AppTableField(larkbitable.NewAppTableFieldBuilder().
+			FieldName(larkcore.StringValue(field.FieldName)).
+			Type(larkcore.IntValue(field.Type)).
+			Property(property).
+			Build()).
+		Build()
+
+	// 更新为完整的选项列表, 重复执行结果相同, 可以安全重试
+	return f.withRetry("update field", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		resp, err := f.Client.Bitable.AppTableField.Update(context.Background(), req, larkcore.WithTenantAccessToken(token))
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return resp.ApiResp, resp.CodeError, nil
+	})
+}
+
+// newOptions 根据选项名称生成新选项
+func newOptions(names []string) []*larkbitable.AppTableFieldPropertyOption {
+	options := make([]*larkbitable.AppTableFieldPropertyOption, len(names))
+	for i, name := range names {
+		options[i] = larkbitable.NewAppTableFieldPropertyOptionBuilder().Name(name).Build()
+	}
+	return options
+}
@@ -0,0 +1,170 @@
+package feishu
+
+import (
+	"errors"
+	"fmt"
+	"github.com/larksuite/oapi-sdk-go/v3/core"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 飞书限流相关错误码, 请求被拒绝且未被处理, 重试总是安全的
+var rateLimitCodes = map[int]bool{
+	99991400: true, // 应用请求频率超限
+	1254290:  true, // 多维表格请求过于频繁
+}
+
+// attemptFunc 发起一次请求, 返回原始响应、业务错误码和传输错误
+type attemptFunc func() (*larkcore.ApiResp, larkcore.CodeError, error)
+
+// withRetry 按照 FeiShu.Retry 配置执行请求.
+// idempotent 为 false 时, 只重试确定未被服务端处理的请求(连接失败、限流),
+// 避免没有幂等键的新建请求被重复执行
+func (f *FeiShuLib) withRetry(name string, idempotent bool, attempt attemptFunc) error {
+	policy := f.Setting.FeiShu.Retry
+
+	var lastErr error
+	for i := 0; i < policy.Attempts; i++ {
+		if i > 0 {
+			time.Sleep(f.backoff(i, lastErr))
+		}
+
+		resp, codeError, err := attempt()
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", name, err)
+			if !retryableError(err, idempotent) {
+				return lastErr
+			}
+			log.Printf("%s attempt %d failed: %v", name, i+1, err)
+			continue
+		}
+
+		if codeError.Code == 0 {
+			return nil
+		}
+
+		lastErr = &retryError{
+			err: &APIError{
+				Op:         name,
+				Code:       codeError.Code,
+				Msg:        codeError.Msg,
+				RequestId:  resp.RequestId(),
+				StatusCode: resp.StatusCode,
+			},
+			after: retryAfter(resp),
+		}
+		rateLimited := rateLimitCodes[codeError.Code] || resp.StatusCode == http.StatusTooManyRequests
+		if !rateLimited && !(idempotent && resp.StatusCode >= http.StatusInternalServerError) {
+			return lastErr
+		}
+		log.Printf("%s attempt %d failed: %v", name, i+1, lastErr)
+	}
+	return lastErr
+}
+
+// backoff 计算第 n 次重试前的等待时间, 优先使用服务端返回的重试提示
+func (f *FeiShuLib) backoff(n int, lastErr error) time.Duration {
+	policy := f.Setting.FeiShu.Retry
+
+	var hinted *retryError
+	if errors.As(lastErr, &hinted) && hinted.after > 0 {
+		return hinted.after
+	}
+
+	wait := policy.Backoff << (n - 1)
+	if wait > policy.MaxBackoff || wait <= 0 {
+		wait = policy.MaxBackoff
+	}
+	if policy.Jitter > 0 {
+		delta := float64(wait) * policy.Jitter
+		wait += time.Duration(delta * (2*rand.Float64() - 1))
+	}
+	return wait
+}
+
+// retryableError 判断传输层错误是否可以重试
+func retryableError(err error, idempotent bool) bool {
+	var illegalParam *larkcore.IllegalParamError
+	if errors.As(err, &illegalParam) {
+		return false
+	}
+	// 连接未建立, 请求没有发出
+	var dialFailed *larkcore.DialFailedError
+	if errors.As(err, &dialFailed) {
+		return true
+	}
+	return idempotent
+}
+
+// retryAfter 读取响应头中的重试提示
+func retryAfter(resp *larkcore.ApiResp) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	for _, header := range []string{"x-ogw-ratelimit-reset", "Retry-After"} {
+		if seconds, err := strconv.Atoi(resp.Header.Get(header)); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// retryError 服务端返回的错误, 附带重试提示
+type retryError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryError) Unwrap() error {
+	return e.err
+}
+
+// APIError 飞书接口返回的业务错误, 可以通过 errors.As 取得错误码和请求 ID
+type APIError struct {
+	Op         string // 请求名称, 如 batch create records
+	Code       int
+	Msg        string
+	RequestId  string
+	StatusCode int
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %d %s (request id %s)", e.Op, e.Code, e.Msg, e.RequestId)
+}
+
+// 多维表格校验记录内容失败的错误码, 只与被拒绝的记录有关, 其他记录可以正常写入
+var rejectedCodes = map[int]bool{
+	1254010: true, // ReqConvError, 请求中的字段值无法转换
+	1254015: true, // 字段值与字段类型不匹配
+	1254060: true, // TextFieldConvFail
+	1254061: true, // NumberFieldConvFail
+	1254062: true, // SingleSelectFieldConvFail
+	1254063: true, // MultiSelectFieldConvFail
+	1254064: true, // DatetimeFieldConvFail
+	1254065: true, // CheckboxFieldConvFail
+	1254066: true, // UserFieldConvFail
+	1254067: true, // LinkFieldConvFail
+	1254068: true, // URLFieldConvFail
+	1254069: true, // AttachFieldConvFail
+	1254072: true, // PhoneFieldConvFail
+	1254074: true, // DuplexLinkFieldConvFail
+	1254130: true, // TooLargeCell, 单元格内容超过限制
+}
+
+// IsRejected 判断错误是否为飞书拒绝了记录内容, 如字段值不合法.
+// 只有多维表格校验记录内容的错误码属于此类; 鉴权、权限、base_id 或 table_id 错误等其他错误,
+// 以及限流、服务端错误和网络错误都会导致所有记录失败, 不能作为单条记录跳过
+func IsRejected(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return rejectedCodes[apiErr.Code]
+}
@@ -0,0 +1,110 @@
+package feishu
+
+import (
+	"context"
+	"github.com/larksuite/oapi-sdk-go/v3/core"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	"strconv"
+	"time"
+)
+
+// 查询记录接口单页最多返回的记录数
+const searchPageSize = 500
+
+// SearchModifiedRecords 按页查询修改时间不早于 since(毫秒时间戳) 的记录, 每页调用一次 handle, 返回读到的最晚修改时间.
+// fieldNames 为需要返回的字段. modifiedField 为"最后更新时间"字段, 设置后由飞书按日期初步筛选;
+// 未设置时每次都读取数据表的全部记录, 记录多时应当设置. 两种情况下都按记录的 last_modified_time 精确筛选.
+// since 为 0(第一次写回)时需要读取全部记录, 不设置筛选条件
+func (f *FeiShuLib) SearchModifiedRecords(since int64, modifiedField string, fieldNames []string, handle func(records []*larkbitable.AppTableRecord) error) (int64, error) {
+	body := larkbitable.NewSearchAppTableRecordReqBodyBuilder().
+		FieldNames(fieldNames).
+		AutomaticFields(true)
+	if modifiedField != "" && since > 0 {
+		// 日期筛选只精确到天, 从前一天开始筛选, 避免遗漏同一天的修改
+		day := strconv.FormatInt(since-24*time.Hour.Milliseconds(), 10)
+		body.Filter(larkbitable.NewFilterInfoBuilder().
+			Conjunction("and").
+			Conditions([]*larkbitable.Condition{
+				larkbitable.NewConditionBuilder().
+					FieldName(modifiedField).
+					Operator("isGreater").
+					Value([]string{"ExactDate", day}).
+					Build(),
+			}).
+			Build())
+		body.Sort([]*larkbitable.Sort{
+			larkbitable.NewSortBuilder().FieldName(modifiedField).Desc(false).Build(),
+		})
+	}
+
+	latest := since
+	pageToken := ""
+	for {
+		records, next, err := f.search(body.Build(), pageToken)
+		if err != nil {
+			return latest, err
+		}
+
+		var modified []*larkbitable.AppTableRecord
+		for _, record := range records {
+			if record.LastModifiedTime == nil || *record.LastModifiedTime < since {
+				continue
+			}
+			modified = append(modified, record)
+			if *record.LastModifiedTime > latest {
+				latest = *record.LastModifiedTime
+			}
+		}
+		if len(modified) > 0 {
+			if err := handle(modified); err != nil {
+				return latest, err
+			}
+		}
+
+		if next == "" {
+			return latest, nil
+		}
+		pageToken = next
+	}
+}
+
+// search 调用一次查询记录接口, 返回本页记录和下一页的 page_token, 没有下一页时为空
+func (f *FeiShuLib) search(body *larkbitable.SearchAppTableRecordReqBody, pageToken string) ([]*larkbitable.AppTableRecord, string, error) {
+	token, err := f.GetTenantAccessToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	builder := larkbitable.NewSearchAppTableRecordReqBuilder().
+		AppToken(f.Setting.FeiShu.Drive.BaseId).
+		TableId(f.Setting.FeiShu.Drive.TableId).
+		PageSize(searchPageSize).
+		Body(body)
+	if pageToken != "" {
+		builder.PageToken(pageToken)
+	}
+	req := builder.Build()
+
+	// 查询不修改数据, 可以安全重试
+	var resp *larkbitable.SearchAppTableRecordResp
+	err = f.withRetry("search records", true, func() (*larkcore.ApiResp, larkcore.CodeError, error) {
+		var err error
+		resp, err = f.Client.Bitable.AppTableRecord.Search(context.Background(), req, larkcore.WithTenantAccessToken(token))
+		if err != nil {
+			return nil, larkcore.CodeError{}, err
+		}
+		return resp.ApiResp, resp.CodeError, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.Data == nil {
+		return nil, "", nil
+	}
+
+	next := ""
+	if resp.Data.HasMore != nil && *resp.Data.HasMore && resp.Data.PageToken != nil {
+		next = *resp.Data.PageToken
+	}
+	return resp.Data.Items, next, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"ser163.cn/earthworm/dao"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 运行锁的有效期, 持有期间每隔三分之一有效期续期一次; 进程异常退出后最多等待一个有效期即可被其他进程获取
+const lockTTL = 2 * time.Minute
+
+// lockOwner 本进程持有锁时使用的标识
+var lockOwner = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+}()
+
+// runLock 一个任务的跨进程运行锁, 保存在本地数据库的 locks 表中
+type runLock struct {
+	db        *sql.DB
+	name      string
+	expiresAt time.Time   // 最后一次成功续期后的过期时间, 只由 renew 读写
+	lost      atomic.Bool // 锁已被其他进程接管, 或无法续期直到过期
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// acquireLock 获取名为 name 的运行锁, 并在后台定时续期. 锁由其他进程持有且未过期时返回错误;
+// 持有者是本机上已经退出的进程时直接接管
+func acquireLock(db *sql.DB, name string) (*runLock, error) {
+	host, _ := os.Hostname()
+	lease := dao.Lease{Name: name, Owner: lockOwner, Pid: os.Getpid(), Host: host, ExpiresAt: time.Now().Add(lockTTL)}
+	holder, ok, err := dao.AcquireLease(db, lease)
+	if err != nil {
+		return nil, err
+	}
+	if !ok && holder.Host == host && !processAlive(holder.Pid) {
+		log.Printf("lock %s held by exited process %d, taking over", name, holder.Pid)
+		previous := holder.Owner
+		if holder, ok, err = dao.TakeoverLease(db, lease, previous); err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("lock %s is held by process %d on %s until %s", name, holder.Pid, holder.Host, holder.ExpiresAt.Format("2006-01-02 15:04:05"))
+	}
+
+	lock := &runLock{db: db, name: name, expiresAt: lease.ExpiresAt, stop: make(chan struct{}), done: make(chan struct{})}
+	go lock.renew()
+	return lock, nil
+}
+
+// renew 定时续期, 直到 release 被调用. 锁被其他进程接管或无法续期直到过期时标记为丢失并停止续期
+func (l *runLock) renew() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			expiresAt := time.Now().Add(lockTTL)
+			ok, err := dao.RenewLease(l.db, l.name, lockOwner, expiresAt)
+			switch {
+			case err != nil:
+				log.Printf("Error renewing lock %s: %v", l.name, err)
+				if time.Now().After(l.expiresAt) {
+					log.Printf("lock %s has expired", l.name)
+					l.lost.Store(true)
+					return
+				}
+			case !ok:
+				log.Printf("lock %s has been taken over by another process", l.name)
+				l.lost.Store(true)
+				return
+			default:
+				l.expiresAt = expiresAt
+			}
+		}
+	}
+}
+
+// check 锁已丢失时返回错误, 同步在每页之间检查, 避免与获取了锁的其他进程同时同步. 未持有锁(l 为 nil)时不检查
+func (l *runLock) check() error {
+	if l != nil && l.lost.Load() {
+		return fmt.Errorf("lock %s has been lost", l.name)
+	}
+	return nil
+}
+
+// release 停止续期并释放锁
+func (l *runLock) release() {
+	close(l.stop)
+	<-l.done
+	if err := dao.ReleaseLease(l.db, l.name, lockOwner); err != nil {
+		log.Printf("Error releasing lock %s: %v", l.name, err)
+	}
+}
+
+// processAlive 判断本机上的进程是否仍在运行, 无法判断时按仍在运行处理
+func processAlive(pid int) bool {
+	if runtime.GOOS == "windows" || pid <= 0 {
+		return true
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
@@ -1,53 +1,420 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
+	"github.com/larksuite/oapi-sdk-go/v3/core"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"os"
 	"ser163.cn/earthworm/config"
 	"ser163.cn/earthworm/dao"
 	"ser163.cn/earthworm/feishu"
+	"ser163.cn/earthworm/mapping"
 	"ser163.cn/earthworm/read"
+	"ser163.cn/earthworm/utils"
+	"ser163.cn/earthworm/write"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func main() {
-	conf := config.GetConfig()
-	sqlLitedb, err := dao.ConnectDatabase(conf)
+	// earth <command> [flags], 省略 command 时为 run
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := command.run(args); err != nil {
+		log.Fatalf("Error %s: %v", name, err)
+	}
+}
+
+// 最近一次同步结果在 state 表中的键
+const runResultKey = "last_run"
+
+// 任务运行锁在 locks 表中的名称
+const runLockKey = "run"
+
+// job 一个同步任务使用的连接和客户端
+type job struct {
+	conf         *config.Config
+	sqlLitedb    *sql.DB
+	sourceDb     *sql.DB
+	readClient   *read.ReadLib
+	feishuClient *feishu.FeiShuLib
+	running      sync.Mutex  // daemon 模式下避免同一个任务重叠运行, 读取 binlog 时每个事务在持有期间同步
+	streaming    atomic.Bool // 正在读取 binlog, 本进程持有运行锁
+}
+
+// newJob 创建任务的客户端, sourceDb 为源数据库连接, 从文件读取时为 nil
+func newJob(conf *config.Config, sqlLitedb *sql.DB, sourceDb *sql.DB) *job {
+	return &job{
+		conf:         conf,
+		sqlLitedb:    sqlLitedb,
+		sourceDb:     sourceDb,
+		readClient:   read.NewReadLib(conf, sourceDb, sqlLitedb),
+		feishuClient: feishu.NewFeiShuLib(conf, sqlLitedb),
+	}
+}
+
+// lock 获取任务的跨进程运行锁, 避免多个进程同时同步同一个任务
+func (j *job) lock() (*runLock, error) {
+	return acquireLock(j.sqlLitedb, j.conf.StateKey(runLockKey))
+}
+
+// tryLock 任务没有在运行时获取运行锁, 返回释放函数; 任务正在同步或运行锁被其他进程持有时返回 false.
+// 读取 binlog 期间本进程已持有运行锁, 只需要避免与正在同步的事务重叠
+func (j *job) tryLock() (func(), bool) {
+	if !j.running.TryLock() {
+		return nil, false
+	}
+	if j.streaming.Load() {
+		return j.running.Unlock, true
+	}
+	lock, err := j.lock()
 	if err != nil {
-		log.Fatalf("Error connecting to database: %v", err)
+		j.running.Unlock()
+		log.Printf("job %s: %v", jobLabel(j.conf), err)
+		return nil, false
 	}
+	return func() {
+		lock.release()
+		j.running.Unlock()
+	}, true
+}
 
-	// 获取业务本地数据
-	Mysqldb, err := dao.ConnectMysqlDatabase(conf)
+// run 持有运行锁同步一次并保存结果, 供 status 查看
+func (j *job) run() error {
+	lock, err := j.lock()
 	if err != nil {
-		log.Fatalf("Error connecting to database: %v", err)
+		return err
 	}
+	defer lock.release()
+	defer j.readClient.EndRun()
 
-	defer sqlLitedb.Close()
-	defer Mysqldb.Close()
+	result := dao.RunResult{StartedAt: time.Now()}
+	err = j.sync(lock)
+	result.FinishedAt = time.Now()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if err := dao.SaveRunResult(j.sqlLitedb, j.conf.StateKey(runResultKey), result); err != nil {
+		log.Printf("Error saving run result: %v", err)
+	}
+	return err
+}
+
+// tryRun 任务上一次运行尚未结束时跳过, 否则同步一次, 出错时只记录日志, 供 daemon 定时调用
+func (j *job) tryRun() {
+	if !j.running.TryLock() {
+		log.Printf("job %s is still running, skip", jobLabel(j.conf))
+		return
+	}
+	defer j.running.Unlock()
+
+	log.Printf("running job %s", jobLabel(j.conf))
+	if err := j.run(); err != nil {
+		log.Printf("Error running job %s: %v", jobLabel(j.conf), err)
+	}
+}
+
+// sync 同步一次: 写回飞书中的修改, 新建新数据, 更新修改和删除的数据.
+// 每页之间检查运行锁 lock, 锁丢失时停止同步并返回错误; 不修改本地数据库时 lock 为 nil
+func (j *job) sync(lock *runLock) error {
+	conf := j.conf
+	readClient := j.readClient
+	feishuClient := j.feishuClient
+	sqlLitedb := j.sqlLitedb
 
-	// 获取需要更新的数据
-	readClient := read.NewReadLib(Mysqldb, sqlLitedb)
+	// 同步前检查数据表结构, 避免字段被改名或删除后写入失败
+	if err := checkSchema(feishuClient); err != nil {
+		return fmt.Errorf("checking table schema: %v", err)
+	}
+
+	// 开启 binlog 时先记录位置, 读取现有数据期间的变更之后从 binlog 补上
+	if conf.Read.Binlog.Enabled {
+		if err := readClient.PrepareBinlog(); err != nil {
+			return fmt.Errorf("preparing binlog: %v", err)
+		}
+	}
 
-	records, err := readClient.Transfer()
+	// 先将飞书中修改的字段写回源数据库, 避免之后同步源数据时覆盖飞书中尚未读取的修改;
+	// 只预览时不修改源数据库
+	if conf.Sync.Pull.Enabled && !feishuClient.DryRun {
+		if err := pull(feishuClient, readClient, write.NewWriteLib(conf, j.sourceDb, sqlLitedb), sqlLitedb, lock); err != nil {
+			return fmt.Errorf("pulling records: %v", err)
+		}
+	}
+
+	// 逐页读取新数据, 直到没有新数据
+	for {
+		if err := lock.check(); err != nil {
+			return err
+		}
+		records, err := readClient.Transfer()
+		if err != nil {
+			return fmt.Errorf("transfer from read: %v", err)
+		}
+		if readClient.Done() {
+			break
+		}
+
+		if err := syncPage(feishuClient, readClient, sqlLitedb, records); err != nil {
+			return fmt.Errorf("syncing records: %v", err)
+		}
+
+		// 更新本地记录
+		err = readClient.UploadLocalRecord()
+		if err != nil {
+			return fmt.Errorf("uploading record: %v", err)
+		}
+	}
+
+	// 将已同步数据的修改更新到飞书
+	if conf.Sync.Update.Enabled {
+		if err := readClient.BeginUpdates(); err != nil {
+			return fmt.Errorf("loading update cursor: %v", err)
+		}
+		// 逐页查找并更新, 全部完成后才保存进度
+		for {
+			if err := lock.check(); err != nil {
+				return err
+			}
+			updates, entries, err := readClient.Updates()
+			if err != nil {
+				return fmt.Errorf("finding updates: %v", err)
+			}
+			if readClient.UpdatesDone() {
+				break
+			}
+			_, err = feishuClient.NewBatchUpdateRecord(updates, func(offset, count int) error {
+				return dao.SaveLedgerEntries(sqlLitedb, entries[offset:offset+count])
+			})
+			if err != nil {
+				return fmt.Errorf("updating records: %v", err)
+			}
+		}
+		if err := readClient.SaveUpdateCursor(); err != nil {
+			return fmt.Errorf("saving update cursor: %v", err)
+		}
+	}
+
+	// 删除或归档源数据已被删除的飞书记录
+	if conf.Sync.Delete.Enabled {
+		err := readClient.Deletions(func(entries []dao.LedgerEntry) error {
+			if err := lock.check(); err != nil {
+				return err
+			}
+			return syncDeletions(feishuClient, sqlLitedb, entries)
+		})
+		if err != nil {
+			return fmt.Errorf("deleting records: %v", err)
+		}
+	}
+	return nil
+}
+
+// stream 持续读取 binlog, 将新建、修改和删除同步到飞书
+func (j *job) stream() error {
+	// 等待正在处理的飞书事件释放运行锁
+	j.running.Lock()
+	lock, err := j.lock()
+	if err == nil {
+		j.streaming.Store(true)
+	}
+	j.running.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		j.streaming.Store(false)
+		lock.release()
+	}()
+
+	return j.readClient.Stream(func(records []*larkbitable.AppTableRecord) error {
+		// 避免与写回飞书事件同时修改
+		j.running.Lock()
+		defer j.running.Unlock()
+
+		if err := lock.check(); err != nil {
+			return err
+		}
+		if err := syncPage(j.feishuClient, j.readClient, j.sqlLitedb, records); err != nil {
+			return err
+		}
+		if !j.conf.Sync.Delete.Enabled {
+			return nil
+		}
+		return syncDeletions(j.feishuClient, j.sqlLitedb, j.readClient.PageDeletes())
+	})
+}
+
+// checkSchema 读取数据表的字段, 按 feishu.schema.provision 自动修复后, 与配置仍不一致时返回列出全部问题的错误
+func checkSchema(feishuClient *feishu.FeiShuLib) error {
+	conf := feishuClient.Setting
+	fields, err := feishuClient.ListFields()
+	if err != nil {
+		return err
+	}
+	problems := mapping.CheckSchema(conf, fields)
+	if len(problems) > 0 && conf.FeiShu.Schema.Provision != "" {
+		changed, err := provision(feishuClient, fields, problems)
+		if err != nil {
+			return err
+		}
+		if changed {
+			if fields, err = feishuClient.ListFields(); err != nil {
+				return err
+			}
+			problems = mapping.CheckSchema(conf, fields)
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	lines := make([]string, len(problems))
+	for i, problem := range problems {
+		lines[i] = "  " + problem.String()
+	}
+	return fmt.Errorf("table %s does not match the configuration:\n%s", conf.FeiShu.Drive.TableId, strings.Join(lines, "\n"))
+}
+
+// provision 新建缺少的字段, 为单选、多选字段追加缺少的选项, 返回是否修改了数据表.
+// dry_run 时只输出将要进行的修改
+func provision(feishuClient *feishu.FeiShuLib, fields []*larkbitable.AppTableFieldForList, problems []mapping.SchemaProblem) (bool, error) {
+	dryRun := feishuClient.Setting.FeiShu.Schema.Provision == config.ProvisionDryRun || feishuClient.DryRun
+	tableFields := make(map[string]*larkbitable.AppTableFieldForList, len(fields))
+	for _, field := range fields {
+		tableFields[larkcore.StringValue(field.FieldName)] = field
+	}
+
+	// 同一个字段缺少的选项合并为一次修改, 否则后一次修改会覆盖前一次追加的选项
+	var fixes []mapping.SchemaProblem
+	index := make(map[string]int)
+	for _, problem := range problems {
+		if !problem.Provisionable() {
+			continue
+		}
+		i, ok := index[problem.Field]
+		if !ok {
+			index[problem.Field] = len(fixes)
+			fixes = append(fixes, problem)
+			continue
+		}
+		for _, option := range problem.MissingOptions {
+			if !utils.Contains(fixes[i].MissingOptions, option) {
+				fixes[i].MissingOptions = append(fixes[i].MissingOptions, option)
+			}
+		}
+	}
+
+	for _, fix := range fixes {
+		if dryRun {
+			log.Printf("dry run: %s", fix.Action())
+			continue
+		}
+		log.Print(fix.Action())
+		var err error
+		if fix.Missing {
+			err = feishuClient.CreateField(fix.Field, fix.Expected[0], fix.MissingOptions)
+		} else {
+			err = feishuClient.AddFieldOptions(tableFields[fix.Field], fix.MissingOptions)
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	return !dryRun && len(fixes) > 0, nil
+}
+
+// syncPage 将一页数据写入飞书: 先将本页中已同步过且内容变化的数据更新到飞书, 再新建记录,
+// 每批新建成功后保存对应关系并推进本地记录, 本地记录不会越过尚未写入飞书的数据
+func syncPage(feishuClient *feishu.FeiShuLib, readClient *read.ReadLib, sqlLitedb *sql.DB, records []*larkbitable.AppTableRecord) error {
+	updates, entries := readClient.PageUpdates()
+	_, err := feishuClient.NewBatchUpdateRecord(updates, func(offset, count int) error {
+		return dao.SaveLedgerEntries(sqlLitedb, entries[offset:offset+count])
+	})
 	if err != nil {
-		log.Fatalf("Error transfer from read: %v", err)
-		os.Exit(1)
+		return err
 	}
-	// 调用飞书方法
-	feishuClient := feishu.NewFeiShuLib(sqlLitedb)
 
-	// 新建飞书任务字段
-	_, err = feishuClient.NewBatchCreateRecord(records)
+	// 被飞书拒绝的记录放入无法同步的数据中, 同一批的其他记录继续同步
+	_, err = feishuClient.NewBatchCreateRecord(records, readClient.Keys(), readClient.Commit, readClient.Reject)
+	return err
+}
+
+// pull 查询上次进度之后修改过的飞书记录, 逐页按冲突策略写回源数据库, 再将这些源数据重新同步到飞书并更新对应关系,
+// 全部完成后保存进度. 每页之前检查运行锁 lock, 锁丢失时停止并返回错误
+func pull(feishuClient *feishu.FeiShuLib, readClient *read.ReadLib, writeClient *write.WriteLib, sqlLitedb *sql.DB, lock *runLock) error {
+	since, err := writeClient.LoadCursor()
 	if err != nil {
-		log.Fatalf("Error creating records: %v", err)
+		return err
+	}
+	fieldNames, err := writeClient.FieldNames()
+	if err != nil {
+		return err
 	}
 
-	// 更新本地记录
-	err = readClient.UploadLocalRecord()
+	latest, err := feishuClient.SearchModifiedRecords(since, feishuClient.Setting.Sync.Pull.ModifiedField, fieldNames, func(records []*larkbitable.AppTableRecord) error {
+		if err := lock.check(); err != nil {
+			return err
+		}
+		return applyPulled(feishuClient, readClient, writeClient, sqlLitedb, records)
+	})
 	if err != nil {
-		log.Fatalf("Error uploading record: %v", err)
-		os.Exit(1)
+		return err
 	}
+	return writeClient.SaveCursor(latest)
+}
 
+// applyPulled 将一页飞书记录按冲突策略写回源数据库, 再将这些源数据重新同步到飞书并更新对应关系
+func applyPulled(feishuClient *feishu.FeiShuLib, readClient *read.ReadLib, writeClient *write.WriteLib, sqlLitedb *sql.DB, records []*larkbitable.AppTableRecord) error {
+	ids, err := writeClient.Apply(records)
+	if err != nil {
+		return err
+	}
+	updates, entries, err := readClient.Resync(ids)
+	if err != nil {
+		return err
+	}
+	_, err = feishuClient.NewBatchUpdateRecord(updates, func(offset, count int) error {
+		return dao.SaveLedgerEntries(sqlLitedb, entries[offset:offset+count])
+	})
+	return err
+}
+
+// syncDeletions 按任务的配置删除或归档对应的飞书记录, 每批成功后更新对应关系
+func syncDeletions(feishuClient *feishu.FeiShuLib, sqlLitedb *sql.DB, entries []dao.LedgerEntry) error {
+	conf := feishuClient.Setting
+	if conf.Sync.Delete.Mode == "archive" {
+		archives := make([]*larkbitable.AppTableRecord, len(entries))
+		for i := range entries {
+			archives[i] = &larkbitable.AppTableRecord{
+				RecordId: &entries[i].RecordId,
+				Fields:   map[string]interface{}{conf.Sync.Delete.ArchiveField: conf.Sync.Delete.ArchiveValue},
+			}
+		}
+		_, err := feishuClient.NewBatchUpdateRecord(archives, func(offset, count int) error {
+			return dao.ArchiveLedgerEntries(sqlLitedb, entries[offset:offset+count])
+		})
+		return err
+	}
+
+	recordIds := make([]string, len(entries))
+	for i, entry := range entries {
+		recordIds[i] = entry.RecordId
+	}
+	_, err := feishuClient.NewBatchDeleteRecord(recordIds, func(offset, count int) error {
+		return dao.DeleteLedgerEntries(sqlLitedb, entries[offset:offset+count])
+	})
+	return err
 }
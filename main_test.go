@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"ser163.cn/earthworm/dao"
+	"ser163.cn/earthworm/write"
+	"strings"
+	"testing"
+)
+
+func TestJobsUseOwnConfig(t *testing.T) {
+	fake := &fakeBitable{}
+	eventJobs, state, _ := newEventTest(t, fake)
+
+	// 任务 a 归档并按"修改时间"筛选, 任务 b 删除并读取全部记录
+	a, b := eventJobs[0].job, eventJobs[1].job
+	a.conf.Sync.Delete.Mode = "archive"
+	a.conf.Sync.Delete.ArchiveField = "状态"
+	a.conf.Sync.Delete.ArchiveValue = "已删除"
+	a.conf.Sync.Pull.ModifiedField = "修改时间"
+	b.conf.Sync.Delete.Mode = "delete"
+
+	tests := []struct {
+		j        *job
+		deletion string
+		filtered bool
+	}{
+		{a, "batch_update", true},
+		{b, "batch_delete", false},
+	}
+	for _, tt := range tests {
+		name := tt.j.conf.Job
+		entry, err := dao.GetLedgerEntry(state, tt.j.conf.LedgerTable(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := syncDeletions(tt.j.feishuClient, state, []dao.LedgerEntry{*entry}); err != nil {
+			t.Fatalf("job %s: %v", name, err)
+		}
+		if action := fake.lastRequest().Action; action != tt.deletion {
+			t.Errorf("job %s deleted with %s, want %s", name, action, tt.deletion)
+		}
+
+		writeClient := write.NewWriteLib(tt.j.conf, tt.j.sourceDb, state)
+		if err := writeClient.SaveCursor(1000); err != nil {
+			t.Fatal(err)
+		}
+		if err := pull(tt.j.feishuClient, tt.j.readClient, writeClient, state, nil); err != nil {
+			t.Fatalf("job %s: %v", name, err)
+		}
+		search := fake.lastRequest()
+		if search.Action != "search" {
+			t.Fatalf("job %s: last request %s, want search", name, search.Action)
+		}
+		if filtered := strings.Contains(search.Body, "修改时间"); filtered != tt.filtered {
+			t.Errorf("job %s: search filtered by modified time %v, want %v: %s", name, filtered, tt.filtered, search.Body)
+		}
+	}
+}
+
+func TestPullStopsWhenLockLost(t *testing.T) {
+	fake := &fakeBitable{records: map[string]map[string]interface{}{
+		"rec1": {"状态": "closed"},
+	}}
+	eventJobs, state, source := newEventTest(t, fake)
+	j := eventJobs[0].job
+
+	lock, err := j.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.release()
+	// 模拟续期时发现锁已被其他进程接管
+	lock.lost.Store(true)
+
+	writeClient := write.NewWriteLib(j.conf, j.sourceDb, state)
+	if err := pull(j.feishuClient, j.readClient, writeClient, state, lock); err == nil {
+		t.Fatal("pull succeeded after the lock was lost")
+	}
+	var status string
+	if err := source.QueryRow(`SELECT status FROM feedback WHERE id = 1`).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != "open" {
+		t.Errorf("status %q written after the lock was lost", status)
+	}
+	if since, err := writeClient.LoadCursor(); err != nil || since != 0 {
+		t.Errorf("cursor %d saved after the lock was lost: %v", since, err)
+	}
+}
+
+// localLastId 读取任务 job 自增主键模式的本地记录, 没有记录时为 0
+func localLastId(t *testing.T, state *sql.DB, job string) int64 {
+	t.Helper()
+	var id sql.NullInt64
+	if err := state.QueryRow(`SELECT MAX(feed_id) FROM records WHERE job = ?`, job).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id.Int64
+}
+
+func TestUploadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      fakeError
+		rejected bool
+	}{
+		// token 无效, 所有记录都会失败
+		{"auth", fakeError{Status: http.StatusBadRequest, Code: 99991663}, false},
+		// 没有多维表格的权限
+		{"permission", fakeError{Status: http.StatusForbidden, Code: 1254302}, false},
+		// 数字字段的值无法转换, 只与这条记录有关
+		{"field", fakeError{Status: http.StatusBadRequest, Code: 1254061}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeBitable{createError: &tt.err}
+			eventJobs, state, source := newEventTest(t, fake)
+			j := eventJobs[0].job
+			if _, err := source.Exec(`INSERT INTO feedback (id, status) VALUES (2, 'open'), (3, 'open')`); err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := j.readClient.Transfer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = syncPage(j.feishuClient, j.readClient, state, records)
+			if err == nil {
+				err = j.readClient.UploadLocalRecord()
+			}
+
+			letters, lerr := dao.ListDeadLetters(state, j.conf.Job)
+			if lerr != nil {
+				t.Fatal(lerr)
+			}
+			lastId := localLastId(t, state, j.conf.Job)
+			if tt.rejected {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(letters) != 2 || lastId != 3 {
+					t.Errorf("%d dead letters, local last id %d, want 2 and 3", len(letters), lastId)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("sync succeeded, want an error")
+			}
+			if len(letters) != 0 || lastId != 0 {
+				t.Errorf("%d dead letters, local last id %d, want none and 0", len(letters), lastId)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package mapping
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"ser163.cn/earthworm/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 字段类型, 对应多维表格的字段类型
+const (
+	TypeText         = "text"
+	TypeNumber       = "number"
+	TypeSingleSelect = "single_select"
+	TypeMultiSelect  = "multi_select"
+	TypeDate         = "date"
+	TypeCheckbox     = "checkbox"
+	TypeURL          = "url"
+	TypePhone        = "phone"
+	TypePerson       = "person"
+	TypeLink         = "link"
+	TypeLocation     = "location"
+)
+
+// Converter 将源数据转换为多维表格接口需要的格式
+type Converter func(field config.Field, value interface{}) (interface{}, error)
+
+// converters 字段类型与转换函数的对应关系
+var converters = map[string]Converter{
+	TypeText:         convertText,
+	TypeNumber:       convertNumber,
+	TypeSingleSelect: convertSingleSelect,
+	TypeMultiSelect:  convertMultiSelect,
+	TypeDate:         convertDate,
+	TypeCheckbox:     convertCheckbox,
+	TypeURL:          convertURL,
+	TypePhone:        convertPhone,
+	TypePerson:       convertPerson,
+	TypeLink:         convertLink,
+	TypeLocation:     convertLocation,
+}
+
+// GetConverter 根据字段类型获取转换函数, 未设置类型时按文本处理
+func GetConverter(fieldType string) (Converter, error) {
+	if fieldType == "" {
+		fieldType = TypeText
+	}
+	converter, ok := converters[fieldType]
+	if !ok {
+		return nil, fmt.Errorf("unknown field type %q", fieldType)
+	}
+	return converter, nil
+}
+
+// convertText 文本
+func convertText(field config.Field, value interface{}) (interface{}, error) {
+	return toString(value)
+}
+
+// convertNumber 数字
+func convertNumber(field config.Field, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return nil, nil
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %q to number", v)
+		}
+		return f, nil
+	}
+	return nil, unsupported(value, TypeNumber)
+}
+
+// convertSingleSelect 单选, 取值为选项名称
+func convertSingleSelect(field config.Field, value interface{}) (interface{}, error) {
+	s, err := toString(value)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// convertMultiSelect 多选, 字符串按 separator 拆分
+func convertMultiSelect(field config.Field, value interface{}) (interface{}, error) {
+	return toStringList(field, value)
+}
+
+// convertDate 日期, 转换为毫秒时间戳, 字符串按 layout 和 timezone 解析, 未设置 layout 时也接受 RFC3339
+func convertDate(field config.Field, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UnixMilli(), nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case float64:
+		return int64(v), nil
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return nil, nil
+		}
+
+		location := time.UTC
+		if field.Timezone != "" {
+			var err error
+			location, err = time.LoadLocation(field.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timezone %q: %v", field.Timezone, err)
+			}
+		}
+
+		layout := field.Layout
+		if layout == "" {
+			layout = "2006-01-02 15:04:05"
+		}
+		t, err := time.ParseInLocation(layout, s, location)
+		if err != nil && field.Layout == "" {
+			// 未设置 layout 时也接受带时区的 RFC3339 格式
+			t, err = time.Parse(time.RFC3339Nano, s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q with layout %q", v, layout)
+		}
+		return t.UnixMilli(), nil
+	}
+	return nil, unsupported(value, TypeDate)
+}
+
+// convertCheckbox 复选框
+func convertCheckbox(field config.Field, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case int:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "1", "true", "yes", "y", "是":
+			return true, nil
+		case "", "0", "false", "no", "n", "否":
+			return false, nil
+		}
+		return nil, fmt.Errorf("cannot convert %q to checkbox", v)
+	}
+	return nil, unsupported(value, TypeCheckbox)
+}
+
+// convertURL 超链接, 转换为 {link, text}
+func convertURL(field config.Field, value interface{}) (interface{}, error) {
+	if v, ok := value.(map[string]interface{}); ok {
+		link, _ := v["link"].(string)
+		if link == "" {
+			return nil, fmt.Errorf("url value %v has no link", v)
+		}
+		text, _ := v["text"].(string)
+		if text == "" {
+			text = link
+		}
+		return map[string]interface{}{"link": link, "text": text}, nil
+	}
+
+	s, err := toString(value)
+	if err != nil {
+		return nil, err
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	return map[string]interface{}{"link": s, "text": s}, nil
+}
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9][0-9\- ]*$`)
+
+// convertPhone 电话号码
+func convertPhone(field config.Field, value interface{}) (interface{}, error) {
+	s, err := toString(value)
+	if err != nil {
+		return nil, err
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if !phonePattern.MatchString(s) {
+		return nil, fmt.Errorf("invalid phone number %q", s)
+	}
+	return s, nil
+}
+
+// convertPerson 人员, 转换为 open_id 列表
+func convertPerson(field config.Field, value interface{}) (interface{}, error) {
+	ids, err := toStringList(field, value)
+	if err != nil || ids == nil {
+		return nil, err
+	}
+	persons := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		persons = append(persons, map[string]interface{}{"id": id})
+	}
+	return persons, nil
+}
+
+// convertLink 关联记录, 转换为 record_id 列表
+func convertLink(field config.Field, value interface{}) (interface{}, error) {
+	return toStringList(field, value)
+}
+
+// convertLocation 地理位置, 转换为 "经度,纬度"
+func convertLocation(field config.Field, value interface{}) (interface{}, error) {
+	var parts []string
+	switch v := value.(type) {
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return nil, nil
+		}
+		parts = strings.Split(v, ",")
+	case []interface{}:
+		for _, item := range v {
+			parts = append(parts, fmt.Sprint(item))
+		}
+	default:
+		return nil, unsupported(value, TypeLocation)
+	}
+
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("location %v must be \"longitude,latitude\"", value)
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || math.Abs(lng) > 180 {
+		return nil, fmt.Errorf("invalid longitude %q", parts[0])
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || math.Abs(lat) > 90 {
+		return nil, fmt.Errorf("invalid latitude %q", parts[1])
+	}
+	return strconv.FormatFloat(lng, 'f', -1, 64) + "," + strconv.FormatFloat(lat, 'f', -1, 64), nil
+}
+
+// toString 将基础类型转换为字符串
+func toString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int64, int, uint64, float64, float32, bool:
+		return fmt.Sprint(v), nil
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05"), nil
+	}
+	return "", unsupported(value, TypeText)
+}
+
+// toStringList 将列表或以 separator 分隔的字符串转换为字符串列表
+func toStringList(field config.Field, value interface{}) ([]string, error) {
+	var items []string
+	switch v := value.(type) {
+	case []string:
+		items = v
+	case []interface{}:
+		for _, item := range v {
+			s, err := toString(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, s)
+		}
+	case string:
+		separator := field.Separator
+		if separator == "" {
+			separator = ","
+		}
+		items = strings.Split(v, separator)
+	default:
+		return nil, fmt.Errorf("cannot convert %v (%T) to list", value, value)
+	}
+
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return list, nil
+}
+
+// unsupported 无法转换时的错误
+func unsupported(value interface{}, fieldType string) error {
+	return fmt.Errorf("cannot convert %v (%T) to %s", value, value, fieldType)
+}
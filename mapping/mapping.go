@@ -0,0 +1,127 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"ser163.cn/earthworm/config"
+	"strings"
+	"text/template"
+)
+
+// Mapper 按照配置将源记录转换为多维表格字段
+type Mapper struct {
+	Fields     []config.Field
+	templates  map[string]*template.Template
+	converters map[string]Converter
+}
+
+// 模板中可用的函数
+var templateFuncs = template.FuncMap{
+	"trim": func(v interface{}) string {
+		return strings.TrimSpace(fmt.Sprint(v))
+	},
+}
+
+// NewMapper 创建Mapper实例, 并预先解析所有模板
+func NewMapper(fields []config.Field) (*Mapper, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("mapping is empty")
+	}
+
+	templates := make(map[string]*template.Template)
+	fieldConverters := make(map[string]Converter)
+	for _, field := range fields {
+		if field.Field == "" {
+			return nil, errors.New("mapping: field name is required")
+		}
+
+		converter, err := GetConverter(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("mapping %s: %v", field.Field, err)
+		}
+		fieldConverters[field.Field] = converter
+
+		set := 0
+		if field.Column != "" {
+			set++
+		}
+		if field.Value != nil {
+			set++
+		}
+		if field.Template != "" {
+			set++
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("mapping %s: exactly one of column, value, template is required", field.Field)
+		}
+
+		if field.Template != "" {
+			tmpl, err := template.New(field.Field).
+				Funcs(templateFuncs).
+				Option("missingkey=error").
+				Parse(field.Template)
+			if err != nil {
+				return nil, fmt.Errorf("mapping %s: %v", field.Field, err)
+			}
+			templates[field.Field] = tmpl
+		}
+	}
+
+	return &Mapper{
+		Fields:     fields,
+		templates:  templates,
+		converters: fieldConverters,
+	}, nil
+}
+
+// Map 将一条源记录转换为多维表格字段
+func (m *Mapper) Map(record map[string]interface{}) (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(m.Fields))
+	for _, field := range m.Fields {
+		value, err := m.value(field, record)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", field.Field, err)
+		}
+
+		if value != nil {
+			value, err = m.converters[field.Field](field, value)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %v", field.Field, err)
+			}
+		}
+		args[field.Field] = value
+	}
+	return args, nil
+}
+
+// value 根据配置取得字段的原始值
+func (m *Mapper) value(field config.Field, record map[string]interface{}) (interface{}, error) {
+	switch {
+	case field.Column != "":
+		value, ok := record[field.Column]
+		if !ok {
+			return nil, fmt.Errorf("column %s not found", field.Column)
+		}
+		return value, nil
+	case field.Template != "":
+		var builder strings.Builder
+		if err := m.templates[field.Field].Execute(&builder, templateData(record)); err != nil {
+			return nil, err
+		}
+		return builder.String(), nil
+	default:
+		return field.Value, nil
+	}
+}
+
+// templateData 将 NULL 替换为空字符串, 避免模板输出 <no value>
+func templateData(record map[string]interface{}) map[string]interface{} {
+	data := make(map[string]interface{}, len(record))
+	for key, value := range record {
+		if value == nil {
+			value = ""
+		}
+		data[key] = value
+	}
+	return data
+}
@@ -0,0 +1,234 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"ser163.cn/earthworm/config"
+	"strings"
+	"time"
+)
+
+// ReverseConverter 将多维表格接口返回的字段值转换为写回源数据库的值, value 为 nil 表示字段为空
+type ReverseConverter func(field config.Field, value interface{}) (interface{}, error)
+
+// reverseConverters 字段类型与反向转换函数的对应关系
+var reverseConverters = map[string]ReverseConverter{
+	TypeText:         reverseText,
+	TypeNumber:       reverseNumber,
+	TypeSingleSelect: reverseText,
+	TypeMultiSelect:  reverseList,
+	TypeDate:         reverseDate,
+	TypeCheckbox:     reverseCheckbox,
+	TypeURL:          reverseURL,
+	TypePhone:        reverseText,
+	TypePerson:       reverseList,
+	TypeLink:         reverseList,
+	TypeLocation:     reverseLocation,
+}
+
+// GetReverseConverter 根据字段类型获取反向转换函数, 未设置类型时按文本处理
+func GetReverseConverter(fieldType string) (ReverseConverter, error) {
+	if fieldType == "" {
+		fieldType = TypeText
+	}
+	converter, ok := reverseConverters[fieldType]
+	if !ok {
+		return nil, fmt.Errorf("unknown field type %q", fieldType)
+	}
+	return converter, nil
+}
+
+// ReverseMapper 按照配置将多维表格字段转换为源字段
+type ReverseMapper struct {
+	Fields     []config.Field
+	converters map[string]ReverseConverter
+}
+
+// NewReverseMapper 创建ReverseMapper实例, 每个字段需要设置 field 和 column
+func NewReverseMapper(fields []config.Field) (*ReverseMapper, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("pull fields is empty")
+	}
+
+	fieldConverters := make(map[string]ReverseConverter)
+	for _, field := range fields {
+		if field.Field == "" || field.Column == "" {
+			return nil, errors.New("pull: field and column are required")
+		}
+		converter, err := GetReverseConverter(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("pull %s: %v", field.Field, err)
+		}
+		fieldConverters[field.Field] = converter
+	}
+
+	return &ReverseMapper{
+		Fields:     fields,
+		converters: fieldConverters,
+	}, nil
+}
+
+// FieldNames 需要从多维表格读取的字段名
+func (m *ReverseMapper) FieldNames() []string {
+	names := make([]string, len(m.Fields))
+	for i, field := range m.Fields {
+		names[i] = field.Field
+	}
+	return names
+}
+
+// Map 将一条多维表格记录的字段转换为源字段, 接口不返回空字段, 因此缺少的字段转换为空值
+func (m *ReverseMapper) Map(fields map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(m.Fields))
+	for _, field := range m.Fields {
+		value, err := m.converters[field.Field](field, fields[field.Field])
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", field.Field, err)
+		}
+		values[field.Column] = value
+	}
+	return values, nil
+}
+
+// reverseText 文本、单选、电话号码. 文本字段返回由多段 {type, text} 组成的列表
+func reverseText(field config.Field, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return v, nil
+	case []interface{}:
+		var builder strings.Builder
+		for _, item := range v {
+			segment, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, unsupported(value, TypeText)
+			}
+			text, _ := segment["text"].(string)
+			builder.WriteString(text)
+		}
+		return builder.String(), nil
+	}
+	return toString(value)
+}
+
+// reverseNumber 数字, 整数返回 int64
+func reverseNumber(field config.Field, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), nil
+		}
+		return v, nil
+	case string:
+		return convertNumber(field, v)
+	}
+	return nil, unsupported(value, TypeNumber)
+}
+
+// reverseList 多选、人员、关联记录, 以 separator 连接为字符串.
+// 人员取 id, 关联记录取 record_id
+func reverseList(field config.Field, value interface{}) (interface{}, error) {
+	var items []string
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		for _, item := range v {
+			if object, ok := item.(map[string]interface{}); ok {
+				if ids, ok := object["link_record_ids"].([]interface{}); ok {
+					for _, id := range ids {
+						items = append(items, fmt.Sprint(id))
+					}
+					continue
+				}
+				item = object["id"]
+				if item == nil {
+					item = object["record_id"]
+				}
+			}
+			s, err := toString(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, s)
+		}
+	case map[string]interface{}:
+		return reverseList(field, []interface{}{v})
+	default:
+		return toString(value)
+	}
+
+	separator := field.Separator
+	if separator == "" {
+		separator = ","
+	}
+	return strings.Join(items, separator), nil
+}
+
+// reverseDate 日期, 毫秒时间戳按 layout 和 timezone 格式化
+func reverseDate(field config.Field, value interface{}) (interface{}, error) {
+	var ms int64
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case float64:
+		ms = int64(v)
+	case int64:
+		ms = v
+	default:
+		return nil, unsupported(value, TypeDate)
+	}
+
+	location := time.UTC
+	if field.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(field.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %v", field.Timezone, err)
+		}
+	}
+	layout := field.Layout
+	if layout == "" {
+		layout = "2006-01-02 15:04:05"
+	}
+	return time.UnixMilli(ms).In(location).Format(layout), nil
+}
+
+// reverseCheckbox 复选框, 未勾选时接口不返回该字段
+func reverseCheckbox(field config.Field, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	}
+	return nil, unsupported(value, TypeCheckbox)
+}
+
+// reverseURL 超链接, 取 link
+func reverseURL(field config.Field, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		link, _ := v["link"].(string)
+		return link, nil
+	}
+	return toString(value)
+}
+
+// reverseLocation 地理位置, 返回 "经度,纬度"
+func reverseLocation(field config.Field, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		location, _ := v["location"].(string)
+		return location, nil
+	}
+	return toString(value)
+}
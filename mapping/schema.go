@@ -0,0 +1,265 @@
+package mapping
+
+import (
+	"fmt"
+	"github.com/larksuite/oapi-sdk-go/v3/core"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	"ser163.cn/earthworm/config"
+	"strings"
+)
+
+// 多维表格字段类型编号
+const (
+	FieldText         = 1
+	FieldNumber       = 2
+	FieldSingleSelect = 3
+	FieldMultiSelect  = 4
+	FieldDate         = 5
+	FieldCheckbox     = 7
+	FieldPerson       = 11
+	FieldPhone        = 13
+	FieldURL          = 15
+	FieldAttachment   = 17
+	FieldLink         = 18
+	FieldLookup       = 19
+	FieldFormula      = 20
+	FieldDuplexLink   = 21
+	FieldLocation     = 22
+	FieldCreatedTime  = 1001
+	FieldModifiedTime = 1002
+	FieldCreatedUser  = 1003
+	FieldModifiedUser = 1004
+	FieldAutoSerial   = 1005
+)
+
+// fieldTypeNames 字段类型编号对应的名称, 用于提示
+var fieldTypeNames = map[int]string{
+	FieldText:         "文本",
+	FieldNumber:       "数字",
+	FieldSingleSelect: "单选",
+	FieldMultiSelect:  "多选",
+	FieldDate:         "日期",
+	FieldCheckbox:     "复选框",
+	FieldPerson:       "人员",
+	FieldPhone:        "电话号码",
+	FieldURL:          "超链接",
+	FieldAttachment:   "附件",
+	FieldLink:         "单向关联",
+	FieldLookup:       "查找引用",
+	FieldFormula:      "公式",
+	FieldDuplexLink:   "双向关联",
+	FieldLocation:     "地理位置",
+	FieldCreatedTime:  "创建时间",
+	FieldModifiedTime: "最后更新时间",
+	FieldCreatedUser:  "创建人",
+	FieldModifiedUser: "修改人",
+	FieldAutoSerial:   "自动编号",
+}
+
+// compatibleFields 配置的字段类型可以写入的多维表格字段类型
+var compatibleFields = map[string][]int{
+	TypeText:         {FieldText},
+	TypeNumber:       {FieldNumber},
+	TypeSingleSelect: {FieldSingleSelect},
+	TypeMultiSelect:  {FieldMultiSelect},
+	TypeDate:         {FieldDate},
+	TypeCheckbox:     {FieldCheckbox},
+	TypeURL:          {FieldURL},
+	TypePhone:        {FieldPhone},
+	TypePerson:       {FieldPerson},
+	TypeLink:         {FieldLink, FieldDuplexLink},
+	TypeLocation:     {FieldLocation},
+}
+
+// SchemaProblem 配置与数据表结构不一致的一个字段
+type SchemaProblem struct {
+	Field          string   // 多维表格字段名
+	Type           string   // 配置的字段类型
+	Missing        bool     // 数据表中没有该字段
+	Expected       []int    // 类型不兼容时可以使用的字段类型
+	Actual         int      // 数据表中的字段类型
+	MissingOptions []string // 单选、多选字段中缺少的选项, 缺少字段时为需要创建的选项
+}
+
+// String 以 diff 的形式描述问题: - 缺少字段, ~ 类型不兼容, + 缺少选项
+func (p SchemaProblem) String() string {
+	switch {
+	case p.Missing:
+		return fmt.Sprintf("- %s: field not found, expected %s", p.Field, typeNames(p.Expected))
+	case len(p.Expected) > 0:
+		return fmt.Sprintf("~ %s: field type is %s, expected %s", p.Field, typeName(p.Actual), typeNames(p.Expected))
+	default:
+		return fmt.Sprintf("+ %s: options not found: %s", p.Field, strings.Join(p.MissingOptions, ", "))
+	}
+}
+
+// Provisionable 是否可以自动修复: 新建缺少的字段或追加缺少的选项.
+// 关联字段需要指定关联的数据表, 类型不兼容时修改类型会丢失数据, 都需要手动处理
+func (p SchemaProblem) Provisionable() bool {
+	if p.Missing {
+		return len(p.Expected) > 0 && p.Expected[0] != FieldLink
+	}
+	return len(p.Expected) == 0
+}
+
+// Action 描述自动修复时对数据表的修改
+func (p SchemaProblem) Action() string {
+	if !p.Missing {
+		return fmt.Sprintf("add options to %s: %s", p.Field, strings.Join(p.MissingOptions, ", "))
+	}
+	action := fmt.Sprintf("create field %s: %s", p.Field, typeName(p.Expected[0]))
+	if len(p.MissingOptions) > 0 {
+		action += " with options " + strings.Join(p.MissingOptions, ", ")
+	}
+	return action
+}
+
+// CheckSchema 检查数据表结构是否满足配置: mapping、sync.pull 中的字段存在且类型兼容,
+// 单选、多选的常量值以及归档值是已有的选项, sync.pull.modified_field 是最后更新时间或日期字段
+func CheckSchema(conf *config.Config, tableFields []*larkbitable.AppTableFieldForList) []SchemaProblem {
+	fields := make(map[string]*larkbitable.AppTableFieldForList, len(tableFields))
+	for _, field := range tableFields {
+		fields[larkcore.StringValue(field.FieldName)] = field
+	}
+
+	var problems []SchemaProblem
+	checked := make(map[string]bool)
+	check := func(field config.Field) {
+		if checked[field.Field] {
+			return
+		}
+		checked[field.Field] = true
+		if problem, ok := checkField(field, fields[field.Field]); !ok {
+			problems = append(problems, problem)
+		}
+	}
+	for _, field := range conf.Mapping {
+		check(field)
+	}
+	if conf.Sync.Pull.Enabled {
+		for _, field := range conf.Sync.Pull.Fields {
+			check(field)
+		}
+		if name := conf.Sync.Pull.ModifiedField; name != "" {
+			expected := []int{FieldModifiedTime, FieldDate}
+			field, ok := fields[name]
+			if !ok {
+				problems = append(problems, SchemaProblem{Field: name, Missing: true, Expected: expected})
+			} else if actual := larkcore.IntValue(field.Type); !containsType(expected, actual) {
+				problems = append(problems, SchemaProblem{Field: name, Expected: expected, Actual: actual})
+			}
+		}
+	}
+
+	// 归档时写入的值, 字段为单选或多选时需要是已有的选项
+	if conf.Sync.Delete.Enabled && conf.Sync.Delete.Mode == "archive" {
+		archive := config.Field{Field: conf.Sync.Delete.ArchiveField, Value: conf.Sync.Delete.ArchiveValue}
+		field, ok := fields[archive.Field]
+		switch {
+		case !ok && !checked[archive.Field]:
+			problems = append(problems, SchemaProblem{Field: archive.Field, Type: TypeText, Missing: true, Expected: compatibleFields[TypeText]})
+		case ok && larkcore.IntValue(field.Type) == FieldSingleSelect:
+			archive.Type = TypeSingleSelect
+		case ok && larkcore.IntValue(field.Type) == FieldMultiSelect:
+			archive.Type = TypeMultiSelect
+		}
+		if archive.Type != "" {
+			if missing := missingOptions(archive, field); len(missing) > 0 {
+				problems = append(problems, SchemaProblem{Field: archive.Field, Type: archive.Type, MissingOptions: missing})
+			}
+		}
+	}
+	return problems
+}
+
+// checkField 检查一个配置的字段, 没有问题时第二个返回值为 true
+func checkField(field config.Field, tableField *larkbitable.AppTableFieldForList) (SchemaProblem, bool) {
+	fieldType := field.Type
+	if fieldType == "" {
+		fieldType = TypeText
+	}
+	problem := SchemaProblem{Field: field.Field, Type: fieldType}
+	if tableField == nil {
+		problem.Missing = true
+		problem.Expected = compatibleFields[fieldType]
+		if fieldType == TypeSingleSelect || fieldType == TypeMultiSelect {
+			problem.MissingOptions = missingOptions(field, nil)
+		}
+		return problem, false
+	}
+
+	actual := larkcore.IntValue(tableField.Type)
+	if !containsType(compatibleFields[fieldType], actual) {
+		problem.Expected = compatibleFields[fieldType]
+		problem.Actual = actual
+		return problem, false
+	}
+
+	if fieldType != TypeSingleSelect && fieldType != TypeMultiSelect {
+		return problem, true
+	}
+	problem.MissingOptions = missingOptions(field, tableField)
+	return problem, len(problem.MissingOptions) == 0
+}
+
+// missingOptions 返回常量值中数据表没有的选项, tableField 为 nil 时返回全部常量值.
+// 来自源字段和模板的值无法预先检查
+func missingOptions(field config.Field, tableField *larkbitable.AppTableFieldForList) []string {
+	if field.Value == nil {
+		return nil
+	}
+	var values []string
+	if field.Type == TypeSingleSelect {
+		value, err := convertSingleSelect(field, field.Value)
+		if err != nil || value == nil {
+			return nil
+		}
+		values = []string{value.(string)}
+	} else {
+		var err error
+		if values, err = toStringList(field, field.Value); err != nil {
+			return nil
+		}
+	}
+
+	options := make(map[string]bool)
+	if tableField != nil && tableField.Property != nil {
+		for _, option := range tableField.Property.Options {
+			options[larkcore.StringValue(option.Name)] = true
+		}
+	}
+	var missing []string
+	for _, value := range values {
+		if !options[value] {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
+
+// containsType 判断字段类型是否在列表中
+func containsType(types []int, fieldType int) bool {
+	for _, t := range types {
+		if t == fieldType {
+			return true
+		}
+	}
+	return false
+}
+
+// typeName 字段类型编号的名称
+func typeName(fieldType int) string {
+	if name, ok := fieldTypeNames[fieldType]; ok {
+		return fmt.Sprintf("%s(%d)", name, fieldType)
+	}
+	return fmt.Sprintf("%d", fieldType)
+}
+
+// typeNames 以 / 连接多个字段类型的名称
+func typeNames(types []int) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = typeName(t)
+	}
+	return strings.Join(names, " / ")
+}
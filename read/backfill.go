@@ -0,0 +1,54 @@
+package read
+
+import (
+	"errors"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	"ser163.cn/earthworm/dao"
+)
+
+// Backfill 按主键顺序读取 [fromId, toId] 范围内上一页之后的一页数据, 重新同步到飞书, 不改变本地记录.
+// 对应关系中不存在的数据作为需要新建的记录返回, 已同步且内容变化的数据由 PageUpdates 返回;
+// 范围内没有更多数据时 Done 返回 true
+func (r *ReadLib) Backfill(fromId string, toId string) ([]*larkbitable.AppTableRecord, error) {
+	if r.fileMode() {
+		return nil, errors.New("backfill is not supported by the file source")
+	}
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	if err := dao.EnsureLedgerTable(r.SqlLite); err != nil {
+		return nil, err
+	}
+	r.backfilling = true
+
+	idColumn := r.quote(r.Setting.Read.Source.IdColumn)
+	condition := idColumn + ` >= ? AND ` + idColumn + ` <= ?`
+	args := []interface{}{fromId, toId}
+	if r.backfillAt != "" {
+		condition = idColumn + ` > ? AND ` + idColumn + ` <= ?`
+		args[0] = r.backfillAt
+	}
+	query, err := r.buildQuery(condition)
+	if err != nil {
+		return nil, err
+	}
+	query += ` ORDER BY ` + idColumn + ` ` + r.dialect.Limit()
+
+	rows, err := r.query(query, append(args, r.Setting.Read.Mode.Rows)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records, _, err := dao.ScanSourceRows(rows, "")
+	if err != nil {
+		return nil, err
+	}
+
+	r.done = len(records) == 0
+	if len(records) > 0 {
+		if r.backfillAt, err = r.sourceId(records[len(records)-1]); err != nil {
+			return nil, err
+		}
+	}
+	return r.feildToFormatArray(records)
+}
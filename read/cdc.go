@@ -0,0 +1,394 @@
+package read
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	"log"
+	"ser163.cn/earthworm/dao"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 源表没有变更时, 保存 binlog 位置的最短间隔
+	binlogSaveInterval = 10 * time.Second
+	// 要求主库发送心跳的间隔, 超过三个间隔没有收到事件时视为连接断开
+	binlogHeartbeat = 30 * time.Second
+	// 连接断开后重新连接的等待时间, 连续失败时加倍, 最长为 binlogMaxRetryInterval
+	binlogRetryInterval    = 5 * time.Second
+	binlogMaxRetryInterval = time.Minute
+)
+
+// binlogKey binlog 位置在 state 表中的键
+func (r *ReadLib) binlogKey() string {
+	return r.Setting.StateKey("binlog:" + r.Setting.Read.Source.Table)
+}
+
+// PageDeletes 读取 binlog 时, 返回本事务中源数据已被删除的对应关系
+func (r *ReadLib) PageDeletes() []dao.LedgerEntry {
+	return r.pageDeletes
+}
+
+// PrepareBinlog 第一次同步时记录当前的 binlog 位置, 应在读取现有数据之前调用,
+// 读取现有数据期间的变更会在之后由 Stream 补上
+func (r *ReadLib) PrepareBinlog() error {
+	value, err := dao.GetState(r.SqlLite, r.binlogKey())
+	if err != nil || value != "" {
+		return err
+	}
+
+	pos, err := r.masterPosition()
+	if err != nil {
+		return err
+	}
+	log.Println("binlog start position:", formatPosition(pos))
+	return dao.SetState(r.SqlLite, r.binlogKey(), formatPosition(pos))
+}
+
+// Stream 从保存的位置开始持续读取 binlog, 直到出错.
+// 每个修改了源表的事务提交后, 按主键重新查询变更的数据, 与 Transfer 一样生成需要新建的记录交给 apply,
+// 需要修改和删除的记录分别由 PageUpdates 和 PageDeletes 返回; apply 成功后保存 binlog 位置.
+// 连接断开后从最近一个已处理的事务之后重新连接
+func (r *ReadLib) Stream(apply func(records []*larkbitable.AppTableRecord) error) error {
+	if err := r.ensureTableExists(); err != nil {
+		return err
+	}
+	if err := dao.EnsureLedgerTable(r.SqlLite); err != nil {
+		return err
+	}
+	if err := r.PrepareBinlog(); err != nil {
+		return err
+	}
+	value, err := dao.GetState(r.SqlLite, r.binlogKey())
+	if err != nil {
+		return err
+	}
+	pos, err := parsePosition(value)
+	if err != nil {
+		return err
+	}
+
+	idIndex, unsigned, err := r.idColumnPosition()
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := dao.MysqlTLSConfig(r.Setting)
+	if err != nil {
+		return err
+	}
+
+	r.streaming = true
+	defer func() { r.streaming = false }()
+
+	stream := r.newBinlogStream(pos, idIndex, unsigned, apply)
+	settings := r.Setting.Read.Mysql
+	wait := binlogRetryInterval
+	for {
+		syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+			ServerID:        r.Setting.Read.Binlog.ServerId,
+			Flavor:          mysql.MySQLFlavor,
+			Host:            settings.Host,
+			Port:            uint16(settings.Port),
+			User:            settings.Username,
+			Password:        settings.Password,
+			TLSConfig:       tlsConfig,
+			HeartbeatPeriod: binlogHeartbeat,
+			ReadTimeout:     3 * binlogHeartbeat,
+			// 由下面按事务边界重新连接, 避免从事务中间继续读取
+			DisableRetrySync: true,
+		})
+		log.Println("binlog streaming from", formatPosition(stream.committed))
+		err := stream.run(syncer)
+		syncer.Close()
+
+		var connErr *binlogConnError
+		if !errors.As(err, &connErr) {
+			return err
+		}
+		if connErr.received {
+			wait = binlogRetryInterval
+		}
+		log.Printf("binlog connection lost: %v, reconnecting in %s", connErr.err, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > binlogMaxRetryInterval {
+			wait = binlogMaxRetryInterval
+		}
+	}
+}
+
+// binlogConnError 读取 binlog 时连接出错, 可以重新连接, received 表示出错前是否读到过事件
+type binlogConnError struct {
+	err      error
+	received bool
+}
+
+func (e *binlogConnError) Error() string {
+	return e.err.Error()
+}
+
+// binlogStream 读取 binlog 的进度和当前事务中变更的源数据主键
+type binlogStream struct {
+	r         *ReadLib
+	apply     func(records []*larkbitable.AppTableRecord) error
+	idIndex   int  // 主键在表中的位置
+	unsigned  bool // 主键是否为无符号整数
+	current   mysql.Position
+	committed mysql.Position // 最近一个已处理的事务之后的位置
+	ids       []string
+	seen      map[string]bool
+	lastSave  time.Time
+}
+
+// newBinlogStream 从位置 pos 开始处理 binlog 事件
+func (r *ReadLib) newBinlogStream(pos mysql.Position, idIndex int, unsigned bool, apply func(records []*larkbitable.AppTableRecord) error) *binlogStream {
+	return &binlogStream{
+		r:         r,
+		apply:     apply,
+		idIndex:   idIndex,
+		unsigned:  unsigned,
+		current:   pos,
+		committed: pos,
+		seen:      make(map[string]bool),
+		lastSave:  time.Now(),
+	}
+}
+
+// run 从最近一个已处理的事务之后开始读取, 连接出错时返回 binlogConnError
+func (s *binlogStream) run(syncer *replication.BinlogSyncer) error {
+	// 未提交的事务从头重新读取
+	s.current = s.committed
+	s.ids = nil
+	s.seen = make(map[string]bool)
+
+	streamer, err := syncer.StartSync(s.committed)
+	if err != nil {
+		return &binlogConnError{err: err}
+	}
+	received := false
+	for {
+		ev, err := streamer.GetEvent(context.Background())
+		if err != nil {
+			return &binlogConnError{err: err, received: received}
+		}
+		received = true
+		if err := s.handle(ev); err != nil {
+			return err
+		}
+	}
+}
+
+// handle 处理一个 binlog 事件: 记录源表中变更的主键, 事务提交后同步这些数据并保存位置
+func (s *binlogStream) handle(ev *replication.BinlogEvent) error {
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		s.current = mysql.Position{Name: string(e.NextLogName), Pos: uint32(e.Position)}
+		return nil
+	case *replication.RowsEvent:
+		s.advance(ev)
+		return s.rows(e)
+	case *replication.XIDEvent:
+		s.advance(ev)
+		return s.commit()
+	case *replication.QueryEvent:
+		s.advance(ev)
+		// 非事务表的修改以 COMMIT 语句结束
+		if string(e.Query) == "COMMIT" {
+			return s.commit()
+		}
+		return nil
+	}
+	s.advance(ev)
+	return nil
+}
+
+// advance 将当前位置移动到事件之后, 心跳等伪事件的 log_pos 为 0
+func (s *binlogStream) advance(ev *replication.BinlogEvent) {
+	if ev.Header.LogPos > 0 {
+		s.current.Pos = ev.Header.LogPos
+	}
+}
+
+// rows 记录源表中变更的主键, 修改事件包含修改前后两行, 主键被修改时两个主键都需要处理
+func (s *binlogStream) rows(e *replication.RowsEvent) error {
+	r := s.r
+	if string(e.Table.Schema) != r.Setting.Read.Mysql.Database || string(e.Table.Table) != r.Setting.Read.Source.Table {
+		return nil
+	}
+	for _, row := range e.Rows {
+		if s.idIndex >= len(row) {
+			return fmt.Errorf("column %s not found in binlog event", r.Setting.Read.Source.IdColumn)
+		}
+		value := row[s.idIndex]
+		if value == nil {
+			continue
+		}
+		if s.unsigned {
+			value = unsignedValue(value, e.Table.ColumnType[s.idIndex])
+		}
+		id := fmt.Sprint(value)
+		if !s.seen[id] {
+			s.seen[id] = true
+			s.ids = append(s.ids, id)
+		}
+	}
+	return nil
+}
+
+// commit 事务提交后按页同步变更的数据, 再保存 binlog 位置
+func (s *binlogStream) commit() error {
+	r := s.r
+	if len(s.ids) == 0 {
+		s.committed = s.current
+		// 其他表的事务只定期保存位置, 避免频繁写入
+		if time.Since(s.lastSave) < binlogSaveInterval {
+			return nil
+		}
+	} else {
+		// 大事务按页处理
+		rows := int(r.Setting.Read.Mode.Rows)
+		for start := 0; start < len(s.ids); start += rows {
+			end := start + rows
+			if end > len(s.ids) {
+				end = len(s.ids)
+			}
+			records, err := r.changedRecords(s.ids[start:end])
+			if err != nil {
+				return err
+			}
+			if err := s.apply(records); err != nil {
+				return err
+			}
+		}
+		s.ids = nil
+		s.seen = make(map[string]bool)
+		s.committed = s.current
+	}
+
+	s.lastSave = time.Now()
+	return dao.SetState(r.SqlLite, r.binlogKey(), formatPosition(s.committed))
+}
+
+// unsignedValue 将按有符号整数解析的无符号主键转换为无符号整数
+func unsignedValue(value interface{}, columnType byte) interface{} {
+	switch v := value.(type) {
+	case int8:
+		return uint8(v)
+	case int16:
+		return uint16(v)
+	case int32:
+		if columnType == mysql.MYSQL_TYPE_INT24 {
+			return uint32(v) & 0xffffff
+		}
+		return uint32(v)
+	case int64:
+		return uint64(v)
+	}
+	return value
+}
+
+// changedRecords 按主键查询变更后的源数据, 生成需要新建的记录, 并找出已被删除的数据
+func (r *ReadLib) changedRecords(ids []string) ([]*larkbitable.AppTableRecord, error) {
+	records, err := r.fetchRecords(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	r.pageDeletes = nil
+	if r.Setting.Sync.Delete.Enabled {
+		args := make([]interface{}, len(ids))
+		for i, id := range ids {
+			args[i] = id
+		}
+		alive, err := r.aliveIds(args)
+		if err != nil {
+			return nil, err
+		}
+
+		// 软删除的数据不再新建或修改
+		kept := records[:0]
+		for _, record := range records {
+			id, err := r.sourceId(record)
+			if err != nil {
+				return nil, err
+			}
+			if alive[id] {
+				kept = append(kept, record)
+			}
+		}
+		records = kept
+
+		for _, id := range ids {
+			if alive[id] {
+				continue
+			}
+			entry, err := dao.GetLedgerEntry(r.SqlLite, r.Setting.LedgerTable(), id)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			if entry != nil && !entry.Archived {
+				r.pageDeletes = append(r.pageDeletes, *entry)
+			}
+		}
+	}
+	return r.feildToFormatArray(records)
+}
+
+// idColumnPosition 查询主键在表中的位置, 以及是否为无符号整数
+func (r *ReadLib) idColumnPosition() (int, bool, error) {
+	var position int
+	var columnType string
+	query := `SELECT ORDINAL_POSITION, COLUMN_TYPE FROM information_schema.COLUMNS
+			  WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND COLUMN_NAME = ?`
+	err := r.Database.QueryRow(query, r.Setting.Read.Mysql.Database, r.Setting.Read.Source.Table, r.Setting.Read.Source.IdColumn).
+		Scan(&position, &columnType)
+	if err != nil {
+		return 0, false, fmt.Errorf("column %s.%s: %v", r.Setting.Read.Source.Table, r.Setting.Read.Source.IdColumn, err)
+	}
+	return position - 1, strings.Contains(strings.ToLower(columnType), "unsigned"), nil
+}
+
+// masterPosition 查询当前的 binlog 位置
+func (r *ReadLib) masterPosition() (mysql.Position, error) {
+	rows, err := r.Database.Query(`SHOW MASTER STATUS`)
+	if err != nil {
+		// MySQL 8.4 起改为 SHOW BINARY LOG STATUS
+		rows, err = r.Database.Query(`SHOW BINARY LOG STATUS`)
+	}
+	if err != nil {
+		return mysql.Position{}, err
+	}
+	defer rows.Close()
+
+	records, err := dao.ScanRows(rows)
+	if err != nil {
+		return mysql.Position{}, err
+	}
+	if len(records) == 0 {
+		return mysql.Position{}, errors.New("binary logging is not enabled")
+	}
+	return parsePosition(fmt.Sprintf("%v:%v", records[0]["File"], records[0]["Position"]))
+}
+
+// formatPosition 将 binlog 位置格式化为 file:pos
+func formatPosition(pos mysql.Position) string {
+	return fmt.Sprintf("%s:%d", pos.Name, pos.Pos)
+}
+
+// parsePosition 解析 file:pos 格式的 binlog 位置
+func parsePosition(value string) (mysql.Position, error) {
+	i := strings.LastIndex(value, ":")
+	if i <= 0 {
+		return mysql.Position{}, fmt.Errorf("invalid binlog position %q", value)
+	}
+	pos, err := strconv.ParseUint(value[i+1:], 10, 32)
+	if err != nil {
+		return mysql.Position{}, fmt.Errorf("invalid binlog position %q: %v", value, err)
+	}
+	return mysql.Position{Name: value[:i], Pos: uint32(pos)}, nil
+}
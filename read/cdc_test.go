@@ -0,0 +1,84 @@
+package read
+
+import (
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	"ser163.cn/earthworm/dao"
+	"strings"
+	"testing"
+)
+
+// testdata/mysql-bin.000001 按 MySQL 5.7 的 binlog 格式(CRC32 校验)写入三个事务:
+// shop.feedback 新建主键 1 和 4294967295, shop.orders 新建主键 7, shop.feedback 将主键 2 修改为 3.
+// feedback 的字段为 id INT UNSIGNED、title VARCHAR(200)、extra JSON、status ENUM
+func TestBinlogStreamFixture(t *testing.T) {
+	state, source := openTestDatabases(t)
+	if _, err := source.Exec(`CREATE TABLE feedback (id INTEGER PRIMARY KEY, title TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "3", "4294967295"} {
+		if _, err := source.Exec(`INSERT INTO feedback (id, title) VALUES (?, ?)`, id, "t"+id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := testConfig("feedback")
+	conf.Read.Mysql.Database = "shop"
+	conf.Read.Mode.Rows = 10
+	conf.Sync.Delete.Enabled = true
+	r := NewReadLib(conf, source, state)
+	if err := r.ensureTableExists(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dao.EnsureLedgerTable(state); err != nil {
+		t.Fatal(err)
+	}
+	// 主键 2 已同步过, 被修改为 3 后需要删除
+	if err := dao.SaveLedgerEntries(state, []dao.LedgerEntry{{SourceTable: "feedback", SourceId: "2", RecordId: "rec2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var created [][]string
+	var deleted []string
+	stream := r.newBinlogStream(mysql.Position{Name: "mysql-bin.000001", Pos: 4}, 0, true, func(records []*larkbitable.AppTableRecord) error {
+		created = append(created, append([]string(nil), r.Ids...))
+		for _, entry := range r.PageDeletes() {
+			deleted = append(deleted, entry.SourceId)
+		}
+		return nil
+	})
+	// 文件中没有 ROTATE 事件, 文件名与从主库读取时一致
+	parser := replication.NewBinlogParser()
+	parser.SetVerifyChecksum(true)
+	if err := parser.ParseFile("testdata/mysql-bin.000001", 0, stream.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := formatSets(created); got != "[1 4294967295] [3]" {
+		t.Errorf("created %s, want [1 4294967295] [3]", got)
+	}
+	if strings.Join(deleted, " ") != "2" {
+		t.Errorf("deleted %v, want [2]", deleted)
+	}
+	if len(stream.ids) != 0 {
+		t.Errorf("ids %v left after the last commit", stream.ids)
+	}
+
+	value, err := dao.GetState(state, r.binlogKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != formatPosition(stream.current) || !strings.HasPrefix(value, "mysql-bin.000001:") {
+		t.Errorf("saved position %q, want %q", value, formatPosition(stream.current))
+	}
+}
+
+// formatSets 将每次 apply 的主键格式化为 [a b] [c]
+func formatSets(sets [][]string) string {
+	parts := make([]string, len(sets))
+	for i, ids := range sets {
+		parts[i] = "[" + strings.Join(ids, " ") + "]"
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,69 @@
+package read
+
+import (
+	"ser163.cn/earthworm/config"
+	"ser163.cn/earthworm/dao"
+	"ser163.cn/earthworm/utils"
+)
+
+// snapshot 记录源数据中写回字段的当前值, 保存到对应关系中, 未开启写回时返回 old.
+// 待人工处理冲突的字段(open)保留 old 中的值, 查询结果中没有的字段不记录
+func (r *ReadLib) snapshot(record map[string]interface{}, old dao.Snapshot, open map[string]bool) dao.Snapshot {
+	pull := r.Setting.Sync.Pull
+	if !pull.Enabled {
+		return old
+	}
+
+	snapshot := make(dao.Snapshot, len(pull.Fields))
+	for _, field := range pull.Fields {
+		value, ok := record[field.Column]
+		if open[field.Field] || !ok {
+			if base, known := old[field.Column]; known {
+				snapshot[field.Column] = base
+			}
+			continue
+		}
+		if value == nil {
+			snapshot[field.Column] = nil
+			continue
+		}
+		s := utils.ValueString(value)
+		snapshot[field.Column] = &s
+	}
+	return snapshot
+}
+
+// pushFields 返回更新飞书记录时发送的字段: 去掉冲突策略为 bitable 的写回字段和待人工处理冲突的字段(open)
+func (r *ReadLib) pushFields(args map[string]interface{}, open map[string]bool) map[string]interface{} {
+	pull := r.Setting.Sync.Pull
+	if !pull.Enabled {
+		return args
+	}
+
+	fields := make(map[string]interface{}, len(args))
+	for name, value := range args {
+		fields[name] = value
+	}
+	for _, field := range pull.Fields {
+		if open[field.Field] || r.Setting.ConflictPolicy(field.Field) == config.ConflictBitable {
+			delete(fields, field.Field)
+		}
+	}
+	return fields
+}
+
+// openConflicts 查询源数据待人工处理冲突的字段, 没有快照的数据不会有冲突
+func (r *ReadLib) openConflicts(id string, old dao.Snapshot) (map[string]bool, error) {
+	open := make(map[string]bool)
+	if !r.Setting.Sync.Pull.Enabled || old == nil {
+		return open, nil
+	}
+	fields, err := dao.OpenConflictFields(r.SqlLite, r.Setting.LedgerTable(), id)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		open[field] = true
+	}
+	return open, nil
+}
@@ -0,0 +1,89 @@
+package read
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	"log"
+	"ser163.cn/earthworm/dao"
+)
+
+// deadLetter 记录一条无法同步的源数据并跳过, row 为源数据或文件中的原文
+func (r *ReadLib) deadLetter(stage string, id string, row interface{}, cause error) error {
+	content, ok := row.(string)
+	if !ok {
+		value, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		content = string(value)
+	}
+
+	log.Printf("skipping record %s at %s: %v", id, stage, cause)
+	r.failed[id] = true
+	return dao.SaveDeadLetter(r.SqlLite, dao.DeadLetter{
+		Job:         r.Setting.Job,
+		SourceTable: r.Setting.Read.Source.Table,
+		SourceId:    id,
+		Stage:       stage,
+		Row:         content,
+		Error:       cause.Error(),
+	})
+}
+
+// Reject 记录 Transfer 结果中第 index 条被飞书拒绝的记录, 同一批的其他记录继续同步
+func (r *ReadLib) Reject(index int, cause error) error {
+	return r.deadLetter(dao.StageUpload, r.Ids[index], r.rows[index], cause)
+}
+
+// Failed 源数据在本次运行中是否再次无法同步
+func (r *ReadLib) Failed(id string) bool {
+	return r.failed[id]
+}
+
+// RetryDeadLetters 重新读取无法同步的源数据, 返回需要新建的记录, 已同步过且内容变化的由 PageUpdates 返回.
+// 数据库数据源重新查询最新的数据; 文件数据源使用保存的内容, 文件中无法解析的行无法重试.
+// 重试不改变本地记录, 仍然失败的数据由 Failed 返回 true, 尝试次数加一
+func (r *ReadLib) RetryDeadLetters(letters []dao.DeadLetter) ([]*larkbitable.AppTableRecord, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	if err := dao.EnsureLedgerTable(r.SqlLite); err != nil {
+		return nil, err
+	}
+	r.retrying = true
+	r.failed = make(map[string]bool)
+
+	var records []map[string]interface{}
+	if r.fileMode() {
+		for _, letter := range letters {
+			if letter.Stage == dao.StageFetch {
+				log.Printf("record %s can not be parsed, fix the file and drop it", letter.SourceId)
+				r.failed[letter.SourceId] = true
+				continue
+			}
+			decoder := json.NewDecoder(bytes.NewReader([]byte(letter.Row)))
+			decoder.UseNumber()
+			var record map[string]interface{}
+			if err := decoder.Decode(&record); err != nil {
+				return nil, fmt.Errorf("dead letter %d: %v", letter.Id, err)
+			}
+			for name, value := range record {
+				record[name] = normalizeJSON(value)
+			}
+			records = append(records, record)
+		}
+	} else if len(letters) > 0 {
+		ids := make([]string, len(letters))
+		for i, letter := range letters {
+			ids[i] = letter.SourceId
+		}
+		var err error
+		if records, err = r.fetchRecords(ids); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.feildToFormatArray(records)
+}
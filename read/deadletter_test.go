@@ -0,0 +1,74 @@
+package read
+
+import (
+	"ser163.cn/earthworm/dao"
+	"testing"
+)
+
+func TestBadValueSkipsRow(t *testing.T) {
+	state, source := openTestDatabases(t)
+	if _, err := source.Exec(`CREATE TABLE feedback (id INTEGER PRIMARY KEY, amount DECIMAL)`); err != nil {
+		t.Fatal(err)
+	}
+	// 第 2 行的金额无法转换为数字
+	if _, err := source.Exec(`INSERT INTO feedback (id, amount) VALUES (1, 1.5), (2, X'616263'), (3, 2.5)`); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := testConfig("feedback")
+	conf.Read.Mode.Rows = 10
+	r := NewReadLib(conf, source, state)
+	if _, err := r.Transfer(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Ids) != 2 || r.Ids[0] != "1" || r.Ids[1] != "3" {
+		t.Errorf("read %v, want [1 3]", r.Ids)
+	}
+	if !r.Failed("2") {
+		t.Error("row 2 was not marked as failed")
+	}
+	// 跳过的行之后的数据照常推进本地记录
+	if err := r.UploadLocalRecord(); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := r.getLocalLastId(); err != nil || id != 3 {
+		t.Errorf("local last id %d, want 3: %v", id, err)
+	}
+
+	letters, err := dao.ListDeadLetters(state, conf.Job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].SourceId != "2" || letters[0].Stage != dao.StageFetch {
+		t.Fatalf("dead letters %+v, want row 2 at %s", letters, dao.StageFetch)
+	}
+	if letters[0].Row != `{"amount":"abc","id":2}` {
+		t.Errorf("saved row %s", letters[0].Row)
+	}
+}
+
+func TestEndRunClearsRunState(t *testing.T) {
+	state, source := openTestDatabases(t)
+	if _, err := source.Exec(`CREATE TABLE feedback (id INTEGER PRIMARY KEY, amount DECIMAL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Exec(`INSERT INTO feedback (id, amount) VALUES (1, X'616263')`); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReadLib(testConfig("feedback"), source, state)
+	if _, err := r.Backfill("1", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.RetryDeadLetters([]dao.DeadLetter{{SourceId: "1", Stage: dao.StageFetch}}); err != nil {
+		t.Fatal(err)
+	}
+	if !r.backfilling || !r.retrying || !r.Failed("1") {
+		t.Fatal("backfill and retry did not set the run state")
+	}
+
+	r.EndRun()
+	if r.backfilling || r.backfillAt != "" || r.retrying || r.Failed("1") {
+		t.Error("run state was not cleared")
+	}
+}
@@ -0,0 +1,108 @@
+package read
+
+import (
+	"fmt"
+	"ser163.cn/earthworm/dao"
+	"ser163.cn/earthworm/utils"
+)
+
+// Deletions 逐页查找源数据已被删除(或软删除)但仍有对应飞书记录的对应关系, 每页调用一次 handle, 已归档的记录不再返回.
+// 先统计需要删除的记录数, 超过 sync.delete.max_count 或已同步记录的 sync.delete.max_ratio 时不删除任何记录并返回错误,
+// 避免主键字段、表名或软删除标记配置错误时删除全部飞书记录
+func (r *ReadLib) Deletions(handle func(entries []dao.LedgerEntry) error) error {
+	if err := dao.EnsureLedgerTable(r.SqlLite); err != nil {
+		return err
+	}
+
+	deleted, total := 0, 0
+	err := r.deletionPages(func(entries []dao.LedgerEntry, synced int) error {
+		deleted += len(entries)
+		total += synced
+		return nil
+	})
+	if err != nil || deleted == 0 {
+		return err
+	}
+	limit := r.Setting.Sync.Delete
+	if limit.MaxCount > 0 && deleted > limit.MaxCount {
+		return fmt.Errorf("%d of %d synced records are to be deleted, more than sync.delete.max_count %d; check the source configuration", deleted, total, limit.MaxCount)
+	}
+	if float64(deleted) > limit.MaxRatio*float64(total) {
+		return fmt.Errorf("%d of %d synced records are to be deleted, more than sync.delete.max_ratio %v; check the source configuration", deleted, total, limit.MaxRatio)
+	}
+
+	return r.deletionPages(func(entries []dao.LedgerEntry, synced int) error {
+		if len(entries) == 0 {
+			return nil
+		}
+		return handle(entries)
+	})
+}
+
+// deletionPages 按主键顺序逐页读取对应关系, 每页调用一次 handle, entries 为本页中需要删除的对应关系, synced 为本页未归档的记录数
+func (r *ReadLib) deletionPages(handle func(entries []dao.LedgerEntry, synced int) error) error {
+	afterId := ""
+	for {
+		entries, err := dao.ListLedgerEntries(r.SqlLite, r.Setting.LedgerTable(), afterId, int(r.Setting.Read.Mode.Rows))
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		afterId = entries[len(entries)-1].SourceId
+
+		ids := make([]interface{}, 0, len(entries))
+		for _, entry := range entries {
+			ids = append(ids, entry.SourceId)
+		}
+
+		alive, err := r.aliveIds(ids)
+		if err != nil {
+			return err
+		}
+		var deleted []dao.LedgerEntry
+		synced := 0
+		for _, entry := range entries {
+			if entry.Archived {
+				continue
+			}
+			synced++
+			if !alive[entry.SourceId] {
+				deleted = append(deleted, entry)
+			}
+		}
+		if err := handle(deleted, synced); err != nil {
+			return err
+		}
+	}
+}
+
+// aliveIds 查询仍然存在且未被软删除的源数据ID
+func (r *ReadLib) aliveIds(ids []interface{}) (map[string]bool, error) {
+	source := r.Setting.Read.Source
+	idColumn := r.quote(source.IdColumn)
+	query := `SELECT ` + idColumn + ` FROM ` + r.quote(source.Table) +
+		` WHERE ` + idColumn + ` IN (` + utils.BuildPlaceholders(len(ids)) + `)`
+	args := ids
+	if column := r.Setting.Sync.Delete.Column; column != "" {
+		query += ` AND (` + r.quote(column) + ` IS NULL OR ` + r.quote(column) + ` <> ?)`
+		args = append(args, r.Setting.Sync.Delete.Value)
+	}
+
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alive := make(map[string]bool, len(ids))
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		alive[id] = true
+	}
+	return alive, rows.Err()
+}
@@ -0,0 +1,100 @@
+package read
+
+import (
+	"fmt"
+	"ser163.cn/earthworm/dao"
+	"testing"
+)
+
+// deletionTest 源表中 1、2 正常, 3 被软删除, 4 已被物理删除, 对应关系中有 1 到 4
+func deletionTest(t *testing.T) *ReadLib {
+	t.Helper()
+	state, source := openTestDatabases(t)
+	if _, err := source.Exec(`CREATE TABLE feedback (id INTEGER PRIMARY KEY, is_deleted INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Exec(`INSERT INTO feedback (id, is_deleted) VALUES (1, 0), (2, NULL), (3, 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := testConfig("feedback")
+	conf.Read.Mode.Rows = 2
+	conf.Sync.Delete.Value = 1
+	conf.Sync.Delete.MaxRatio = 1
+	if err := dao.EnsureLedgerTable(state); err != nil {
+		t.Fatal(err)
+	}
+	var entries []dao.LedgerEntry
+	for _, id := range []string{"1", "2", "3", "4"} {
+		entries = append(entries, dao.LedgerEntry{SourceTable: conf.LedgerTable(), SourceId: id, RecordId: "rec" + id})
+	}
+	if err := dao.SaveLedgerEntries(state, entries); err != nil {
+		t.Fatal(err)
+	}
+	return NewReadLib(conf, source, state)
+}
+
+// collectDeletions 按页读取需要删除的对应关系, 返回每页的主键
+func collectDeletions(r *ReadLib) ([][]string, error) {
+	var pages [][]string
+	err := r.Deletions(func(entries []dao.LedgerEntry) error {
+		var ids []string
+		for _, entry := range entries {
+			ids = append(ids, entry.SourceId)
+		}
+		pages = append(pages, ids)
+		return nil
+	})
+	return pages, err
+}
+
+func TestDeletions(t *testing.T) {
+	tests := []struct {
+		name   string
+		column string
+		want   string
+	}{
+		{"hard delete", "", "[[4]]"},
+		{"soft delete", "is_deleted", "[[3 4]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := deletionTest(t)
+			r.Setting.Sync.Delete.Column = tt.column
+			pages, err := collectDeletions(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 每页两条对应关系, 第一页没有需要删除的记录时不调用 handle
+			if got := fmt.Sprint(pages); got != tt.want {
+				t.Errorf("deleted %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeletionsLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxCount int
+		maxRatio float64
+	}{
+		{"count", 1, 1},
+		{"ratio", 0, 0.25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := deletionTest(t)
+			r.Setting.Sync.Delete.Column = "is_deleted"
+			r.Setting.Sync.Delete.MaxCount = tt.maxCount
+			r.Setting.Sync.Delete.MaxRatio = tt.maxRatio
+			pages, err := collectDeletions(r)
+			if err == nil {
+				t.Fatal("deleted 2 of 4 records without an error")
+			}
+			if len(pages) != 0 {
+				t.Errorf("deleted %v before checking the limit", pages)
+			}
+		})
+	}
+}
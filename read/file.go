@@ -0,0 +1,253 @@
+package read
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"ser163.cn/earthworm/dao"
+	"strings"
+	"unicode/utf8"
+)
+
+// fileProgress 文件数据源的读取进度
+type fileProgress struct {
+	Offset int64 `json:"offset"` // 已处理的字节数, 从文件开头计算, 为 0 时从表头之后开始
+	Row    int64 `json:"row"`    // 已处理的数据行数, 不含 CSV 表头
+}
+
+// fileMode 是否从文件读取源数据
+func (r *ReadLib) fileMode() bool {
+	return r.Setting.Read.File.Path != ""
+}
+
+// fileKey 文件读取进度在 state 表中的键
+func (r *ReadLib) fileKey() (string, error) {
+	path, err := filepath.Abs(r.Setting.Read.File.Path)
+	if err != nil {
+		return "", err
+	}
+	return r.Setting.StateKey("file:" + path), nil
+}
+
+// loadFileProgress 读取文件的读取进度, 从未读取时返回零值
+func (r *ReadLib) loadFileProgress() (fileProgress, error) {
+	var progress fileProgress
+	key, err := r.fileKey()
+	if err != nil {
+		return progress, err
+	}
+	value, err := dao.GetState(r.SqlLite, key)
+	if err != nil || value == "" {
+		return progress, err
+	}
+	if err := json.Unmarshal([]byte(value), &progress); err != nil {
+		return progress, fmt.Errorf("invalid file progress %q: %v", value, err)
+	}
+	return progress, nil
+}
+
+// saveFileProgress 将文件读取进度推进到本页最后一行
+func (r *ReadLib) saveFileProgress() error {
+	if r.pageFile == nil {
+		return nil
+	}
+	key, err := r.fileKey()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(r.pageFile)
+	if err != nil {
+		return err
+	}
+	if err := dao.SetState(r.SqlLite, key, string(value)); err != nil {
+		return err
+	}
+	r.pageFile = nil
+	return nil
+}
+
+// fetchFilePage 从上次进度开始读取文件中的一页数据.
+// 数据中没有 id_column 字段时以行号作为主键
+func (r *ReadLib) fetchFilePage() ([]map[string]interface{}, error) {
+	progress, err := r.loadFileProgress()
+	if err != nil {
+		return nil, err
+	}
+
+	file := r.Setting.Read.File
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < progress.Offset {
+		// 文件被替换为更短的文件, 从头读取, 已同步的数据按对应关系去重
+		log.Printf("%s is shorter than the saved offset %d, reading from the beginning", file.Path, progress.Offset)
+		progress = fileProgress{}
+	}
+
+	var records []map[string]interface{}
+	var end fileProgress
+	if file.Format == "csv" {
+		records, end, err = r.readCSV(f, progress)
+	} else {
+		records, end, err = r.readJSONL(f, progress)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 整页的行都无法解析时也要推进进度
+	r.pageFile = nil
+	if end.Row > progress.Row {
+		r.pageFile = &end
+	}
+	return records, nil
+}
+
+// readCSV 从 progress 开始读取至多 Mode.Rows 行 CSV 数据, 以表头作为字段名
+func (r *ReadLib) readCSV(f *os.File, progress fileProgress) ([]map[string]interface{}, fileProgress, error) {
+	file := r.Setting.Read.File
+	newReader := func(reader io.Reader) *csv.Reader {
+		csvReader := csv.NewReader(reader)
+		csvReader.Comma, _ = utf8.DecodeRuneInString(file.Delimiter)
+		csvReader.FieldsPerRecord = -1 // 字段数由下面按表头检查
+		return csvReader
+	}
+
+	reader := newReader(f)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, progress, nil
+	}
+	if err != nil {
+		return nil, progress, fmt.Errorf("%s header: %v", file.Path, err)
+	}
+	// 去掉 Excel 导出时添加的 BOM
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	// 表头之后的位置从 0 开始读取时由 reader 计算, 否则定位到上次的位置
+	base := int64(0)
+	if progress.Offset > 0 {
+		if _, err := f.Seek(progress.Offset, io.SeekStart); err != nil {
+			return nil, progress, err
+		}
+		reader = newReader(f)
+		base = progress.Offset
+	}
+
+	idColumn := r.Setting.Read.Source.IdColumn
+	var records []map[string]interface{}
+	row := progress.Row
+	for int64(len(records)) < r.Setting.Read.Mode.Rows {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			return nil, progress, fmt.Errorf("%s row %d: %v", file.Path, row+1, err)
+		}
+		row++
+
+		// 无法解析或字段数与表头不一致的行记录后跳过
+		if err == nil && len(values) != len(header) {
+			err = fmt.Errorf("row has %d fields, header has %d", len(values), len(header))
+		}
+		if err != nil {
+			if err := r.deadLetter(dao.StageFetch, fmt.Sprintf("row %d", row), strings.Join(values, file.Delimiter), err); err != nil {
+				return nil, progress, err
+			}
+			continue
+		}
+
+		record := make(map[string]interface{}, len(header)+1)
+		for i, name := range header {
+			record[name] = values[i]
+		}
+		if _, ok := record[idColumn]; !ok {
+			record[idColumn] = row
+		}
+		records = append(records, record)
+	}
+	return records, fileProgress{Offset: base + reader.InputOffset(), Row: row}, nil
+}
+
+// readJSONL 从 progress 开始读取至多 Mode.Rows 行 JSON 对象, 空行会被跳过, 无法解析的行记录后跳过
+func (r *ReadLib) readJSONL(f *os.File, progress fileProgress) ([]map[string]interface{}, fileProgress, error) {
+	if _, err := f.Seek(progress.Offset, io.SeekStart); err != nil {
+		return nil, progress, err
+	}
+	reader := bufio.NewReader(f)
+
+	idColumn := r.Setting.Read.Source.IdColumn
+	var records []map[string]interface{}
+	offset, row := progress.Offset, progress.Row
+	for int64(len(records)) < r.Setting.Read.Mode.Rows {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, progress, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		offset += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			row++
+			decoder := json.NewDecoder(bytes.NewReader(line))
+			decoder.UseNumber()
+			var record map[string]interface{}
+			if decodeErr := decoder.Decode(&record); decodeErr != nil {
+				// 无法解析的行记录后跳过
+				if err := r.deadLetter(dao.StageFetch, fmt.Sprintf("row %d", row), string(line), decodeErr); err != nil {
+					return nil, progress, err
+				}
+			} else {
+				for name, value := range record {
+					record[name] = normalizeJSON(value)
+				}
+				if _, ok := record[idColumn]; !ok {
+					record[idColumn] = row
+				}
+				records = append(records, record)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return records, fileProgress{Offset: offset, Row: row}, nil
+}
+
+// normalizeJSON 将 json.Number 转换为 int64 或 float64, 与数据库查询结果一致
+func normalizeJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeJSON(v[i])
+		}
+	}
+	return value
+}
@@ -3,10 +3,14 @@ package read
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
 	"log"
 	"ser163.cn/earthworm/config"
+	"ser163.cn/earthworm/dao"
+	"ser163.cn/earthworm/mapping"
 	"ser163.cn/earthworm/utils"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,33 +22,95 @@ type ReadLib struct {
 	SqlLite  *sql.DB
 	Begin    int64
 	End      int64
+	Ids      []string // 与 Transfer 返回的记录一一对应的源数据ID
+	Hashes   []string // 与 Transfer 返回的记录一一对应的字段内容哈希
+
+	snapshots []dao.Snapshot // 与 Transfer 返回的记录一一对应的写回字段快照
+
+	mapper       *mapping.Mapper
+	dialect      dao.Dialect      // 源数据库的 SQL 方言
+	updateCursor *timestampCursor // 本次查找更新时读到的最大更新时间, 不含主键
+	updateAfter  *timestampCursor // 查找更新时上一页最后一条数据的位置, 比较哈希时只使用主键
+	updateDone   bool             // 最近一次 Updates 没有读到数据
+	done         bool             // 最近一次 Transfer 没有读到数据
+
+	// 时间戳模式下, 本页中已同步过且内容变化的数据
+	pageUpdates []*larkbitable.AppTableRecord
+	pageEntries []dao.LedgerEntry
+	pageCursor  *timestampCursor         // 时间戳模式下本页最后一条数据的位置
+	pageDeletes []dao.LedgerEntry        // 读取 binlog 时, 本事务中已被删除的数据
+	pageFile    *fileProgress            // 文件数据源本页最后一行的位置
+	streaming   bool                     // 正在读取 binlog
+	backfilling bool                     // 正在补充同步指定范围的数据
+	backfillAt  string                   // 补充同步时上一页最后一条数据的主键
+	retrying    bool                     // 正在重试无法同步的数据
+	rows        []map[string]interface{} // 与 Transfer 返回的记录一一对应的源数据
+	failed      map[string]bool          // 本次运行中无法同步的源数据
 }
 
-// ReadLib 创建ReadLib实例
-func NewReadLib(mysqldb *sql.DB, sqllite *sql.DB) *ReadLib {
-	conf := config.GetConfig()
+// ReadLib 创建ReadLib实例, conf 为任务的配置
+func NewReadLib(conf *config.Config, sourceDb *sql.DB, sqllite *sql.DB) *ReadLib {
 	return &ReadLib{
 		Setting:  conf,
-		Database: mysqldb,
+		Database: sourceDb,
 		SqlLite:  sqllite,
+		dialect:  dao.GetDialect(conf.Read.Driver),
+		failed:   make(map[string]bool),
 		Begin:    0,
 		End:      0,
 	}
 }
 
-// 加工字段
+// 加工字段, 读取本地记录之后的一页源数据(至多 Mode.Rows 条), 返回需要新建的记录.
+// 没有新数据时 Done 返回 true
 func (r *ReadLib) Transfer() ([]*larkbitable.AppTableRecord, error) {
 	// 确保表存在
 	if err := r.ensureTableExists(); err != nil {
 		return nil, err
 	}
-	// 获取线上最后一条记录
-	remoteLastId, err := r.getLastId()
+	if err := dao.EnsureLedgerTable(r.SqlLite); err != nil {
+		return nil, err
+	}
+
+	var records []map[string]interface{}
+	var err error
+	if r.fileMode() {
+		records, err = r.fetchFilePage()
+	} else if r.timestampMode() {
+		records, err = r.fetchTimestampPage()
+	} else {
+		records, err = r.fetchIdPage()
+	}
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
-	println("remote server id: ", remoteLastId)
+
+	// 文件中读到的行都无法解析时仍有进度需要推进
+	r.done = len(records) == 0 && r.pageFile == nil
+	return r.feildToFormatArray(records)
+}
+
+// Done 最近一次 Transfer 是否没有读到数据
+func (r *ReadLib) Done() bool {
+	return r.done
+}
+
+// EndRun 清除一次运行中的状态: 无法同步的数据, 以及补充同步和重试的标记与进度.
+// 同一个 ReadLib 在 daemon 中多次运行, 每次运行结束后调用, 避免下一次运行不推进本地记录
+func (r *ReadLib) EndRun() {
+	r.failed = make(map[string]bool)
+	r.backfilling = false
+	r.backfillAt = ""
+	r.retrying = false
+}
+
+// PageUpdates 时间戳模式和读取 binlog 时, 返回本页中已同步过且内容发生变化的记录和更新后的对应关系
+func (r *ReadLib) PageUpdates() ([]*larkbitable.AppTableRecord, []dao.LedgerEntry) {
+	return r.pageUpdates, r.pageEntries
+}
+
+// fetchIdPage 按自增主键读取本地记录之后的一页数据
+func (r *ReadLib) fetchIdPage() ([]map[string]interface{}, error) {
 	// 获取本地最后一条记录id
 	localLastId, err := r.getLocalLastId()
 	if err != nil {
@@ -55,66 +121,179 @@ func (r *ReadLib) Transfer() ([]*larkbitable.AppTableRecord, error) {
 			return nil, err
 		}
 	}
-	println("local id: ", localLastId)
-	// 对比本地和远程id
-	if localLastId > remoteLastId {
-		return nil, errors.New("The local last id must be smaller than the remote service last id")
+
+	records, err := r.fetchPage(localLastId, r.Setting.Read.Mode.Rows)
+	if err != nil {
+		return nil, err
 	}
-	// 计算差值,如果太大,则进行报错
-	var difference = remoteLastId - localLastId
-	println("difference: ", difference)
-	if difference > r.Setting.Read.Mode.Rows {
-		return nil, errors.New("The difference is too big, please handle it manually")
+
+	r.Begin = localLastId
+	r.End = localLastId
+	if len(records) > 0 {
+		// 本地记录推进到实际读到的最后一条数据
+		lastId, err := r.sourceId(records[len(records)-1])
+		if err != nil {
+			return nil, err
+		}
+		r.End, err = strconv.ParseInt(lastId, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("column %s must be an integer in id watermark mode: %v", r.Setting.Read.Source.IdColumn, err)
+		}
 	}
+	return records, nil
+}
 
-	ids := utils.GenerateIDList(localLastId, remoteLastId)
-	if ids == nil || len(ids) == 0 {
-		return nil, nil
+// Keys 返回与 Transfer 结果一一对应的源数据标识, 格式为 表名:ID
+func (r *ReadLib) Keys() []string {
+	keys := make([]string, len(r.Ids))
+	for i, id := range r.Ids {
+		keys[i] = r.Setting.Read.Source.Table + ":" + id
 	}
+	return keys
+}
 
-	records, err := r.fetchRecords(ids)
+// Commit 一批记录写入飞书后调用, 保存对应关系; 自增主键模式下在同一个事务中将本地记录推进到
+// 该批中飞书已确认的最大主键, 进程在任意位置退出都不会出现记录已写入而对应关系或本地记录缺失.
+// 读取 binlog、补充同步和重试时数据不在本地记录之后, 只保存对应关系
+func (r *ReadLib) Commit(offset int, created []*larkbitable.AppTableRecord) error {
+	entries, err := r.ledgerEntries(offset, created)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if r.fileMode() || r.timestampMode() || r.streaming || r.backfilling || r.retrying || len(created) == 0 {
+		// 文件和时间戳模式在整页处理完后由 UploadLocalRecord 推进
+		return dao.SaveLedgerEntries(r.SqlLite, entries)
 	}
 
-	if len(records) > 0 {
-		appTableRecords, err := r.feildToFormatArray(records)
+	id := r.Begin
+	for _, entry := range entries {
+		sourceId, err := strconv.ParseInt(entry.SourceId, 10, 64)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if sourceId > id {
+			id = sourceId
 		}
-		r.Begin = localLastId
-		r.End = remoteLastId
-		return appTableRecords, nil
 	}
 
-	return nil, nil
+	tx, err := r.SqlLite.Begin()
+	if err != nil {
+		return err
+	}
+	if err := dao.SaveLedgerEntriesTx(tx, entries); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if id > r.Begin {
+		if err := r.advanceTx(tx, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.Begin = id
+	return nil
+}
+
+// ledgerEntries 生成一批已写入飞书的记录的对应关系, 飞书没有返回 record_id 时视为未确认, 返回错误
+func (r *ReadLib) ledgerEntries(offset int, created []*larkbitable.AppTableRecord) ([]dao.LedgerEntry, error) {
+	now := time.Now()
+	entries := make([]dao.LedgerEntry, 0, len(created))
+	for i, record := range created {
+		if record.RecordId == nil {
+			return nil, fmt.Errorf("record %s has no record_id", r.Ids[offset+i])
+		}
+		entries = append(entries, dao.LedgerEntry{
+			SourceTable: r.Setting.LedgerTable(),
+			SourceId:    r.Ids[offset+i],
+			RecordId:    *record.RecordId,
+			ContentHash: r.Hashes[offset+i],
+			SyncedAt:    now,
+			Snapshot:    r.snapshots[offset+i],
+		})
+	}
+	return entries, nil
+}
+
+// sourceId 读取源数据的主键, 转换为字符串
+func (r *ReadLib) sourceId(record map[string]interface{}) (string, error) {
+	idColumn := r.Setting.Read.Source.IdColumn
+	switch id := record[idColumn].(type) {
+	case int64:
+		return strconv.FormatInt(id, 10), nil
+	case uint64:
+		return strconv.FormatUint(id, 10), nil
+	case string:
+		return id, nil
+	default:
+		return "", fmt.Errorf("column %s has unsupported value %v (%T)", idColumn, id, id)
+	}
 }
 
-// 将[]map[string]interface{} 转换为 []*larkbitable.AppTableRecord
+// 将[]map[string]interface{} 转换为 []*larkbitable.AppTableRecord.
+// 对应关系中已存在的数据不再新建, 内容变化的放入 pageUpdates, 本地记录被回退后也不会重复新建
 func (r *ReadLib) feildToFormatArray(orgRecords []map[string]interface{}) ([]*larkbitable.AppTableRecord, error) {
+	mapper, err := r.getMapper()
+	if err != nil {
+		return nil, err
+	}
+
 	tableRecords := make([]*larkbitable.AppTableRecord, 0)
+	r.Ids = make([]string, 0, len(orgRecords))
+	r.Hashes = make([]string, 0, len(orgRecords))
+	r.snapshots = make([]dao.Snapshot, 0, len(orgRecords))
+	r.rows = make([]map[string]interface{}, 0, len(orgRecords))
+	r.pageUpdates = nil
+	r.pageEntries = nil
 	for _, record := range orgRecords {
-		args := make(map[string]interface{})
-		args["需求描述"] = record["des"]
-		args["需求分类"] = "用户需求反馈"
-		args["需求状态"] = "待评估"
-		args["优先级"] = "低 - P2"
-		createTime, err := utils.TimeStrToUnixMilli(record["add_date"].(string))
+		// 无法识别主键或无法转换的数据记录后跳过, 不影响同一页的其他数据
+		id, err := r.sourceId(record)
 		if err != nil {
-			return nil, err
+			if err := r.deadLetter(dao.StageFetch, fmt.Sprint(record[r.Setting.Read.Source.IdColumn]), record, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := dao.RowError(record); err != nil {
+			if err := r.deadLetter(dao.StageFetch, id, record, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		args, err := mapper.Map(record)
+		if err != nil {
+			if err := r.deadLetter(dao.StageConvert, id, record, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		hash, err := utils.ContentHash(args)
+		if err != nil {
+			return nil, fmt.Errorf("record %s: %v", id, err)
 		}
-		args["需求提出日期"] = createTime // 这里把add_date作为转换
 
-		email := strings.TrimSpace(record["email"].(string))
-		if email != "" {
-			email = " 联系方式: " + email
+		entry, err := dao.GetLedgerEntry(r.SqlLite, r.Setting.LedgerTable(), id)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if entry != nil {
+			if entry.ContentHash != hash {
+				update, err := r.ledgerUpdate(id, record, args, hash, entry)
+				if err != nil {
+					return nil, err
+				}
+				r.pageUpdates = append(r.pageUpdates, update)
+				r.pageEntries = append(r.pageEntries, *entry)
+			}
+			continue
 		}
 
-		desData := record["des"].(string) + email
-		args["需求详细描述（可附文档）"] = desData
-		// args["父记录"] = ["reculp3iz80VL5"]
-		args["父记录"] = []string{}
-		args["父记录"] = append(args["父记录"].([]string), "recumeyGcqvGUP")
+		r.Ids = append(r.Ids, id)
+		r.Hashes = append(r.Hashes, hash)
+		r.snapshots = append(r.snapshots, r.snapshot(record, nil, nil))
+		r.rows = append(r.rows, record)
 		record := &larkbitable.AppTableRecord{
 			Fields:           args,
 			CreatedTime:      utils.GetNowUnixMilli(),
@@ -125,10 +304,25 @@ func (r *ReadLib) feildToFormatArray(orgRecords []map[string]interface{}) ([]*la
 	return tableRecords, nil
 }
 
+// getMapper 获取字段映射, 只解析一次配置
+func (r *ReadLib) getMapper() (*mapping.Mapper, error) {
+	if r.mapper == nil {
+		mapper, err := mapping.NewMapper(r.Setting.Mapping)
+		if err != nil {
+			return nil, err
+		}
+		r.mapper = mapper
+	}
+	return r.mapper, nil
+}
+
 // FetchRecords 根据ID列表从数据库中查询记录
-func (f *ReadLib) fetchRecords(ids []int64) ([]map[string]interface{}, error) {
+func (f *ReadLib) fetchRecords(ids []string) ([]map[string]interface{}, error) {
 	// 构造 SQL 查询
-	query := `SELECT id, des, email, user_id, add_date FROM book_user_feedback WHERE id IN (` + utils.BuildPlaceholders(len(ids)) + `)`
+	query, err := f.buildQuery(f.quote(f.Setting.Read.Source.IdColumn) + ` IN (` + utils.BuildPlaceholders(len(ids)) + `)`)
+	if err != nil {
+		return nil, err
+	}
 
 	// 将 ids 转换为 interface{} 切片，以传递给 Query
 	args := make([]interface{}, len(ids))
@@ -137,45 +331,64 @@ func (f *ReadLib) fetchRecords(ids []int64) ([]map[string]interface{}, error) {
 	}
 
 	// 执行查询
-	rows, err := f.Database.Query(query, args...)
+	rows, err := f.query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	// 存储结果
-	var records []map[string]interface{}
+	records, _, err := dao.ScanSourceRows(rows, "")
+	return records, err
+}
 
-	for rows.Next() {
-		var id int64
-		var des string
-		var email string
-		var user_id int64
-		var add_date string
+// fetchPage 按主键顺序查询 afterId 之后的至多 limit 条数据
+func (f *ReadLib) fetchPage(afterId int64, limit int64) ([]map[string]interface{}, error) {
+	idColumn := f.quote(f.Setting.Read.Source.IdColumn)
+	query, err := f.buildQuery(idColumn + ` > ?`)
+	if err != nil {
+		return nil, err
+	}
+	query += ` ORDER BY ` + idColumn + ` ` + f.dialect.Limit()
 
-		err := rows.Scan(&id, &des, &email, &user_id, &add_date)
-		if err != nil {
-			return nil, err
-		}
+	rows, err := f.query(query, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		// 保存每条记录
-		record := map[string]interface{}{
-			"id":       id,
-			"des":      des,
-			"email":    email,
-			"user_id":  user_id,
-			"add_date": add_date,
-		}
+	records, _, err := dao.ScanSourceRows(rows, "")
+	return records, err
+}
 
-		records = append(records, record)
-	}
+// query 执行源数据库查询, 将 ? 占位符转换为源数据库的格式
+func (r *ReadLib) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return r.Database.Query(dao.Rebind(r.dialect, query), args...)
+}
 
-	// 检查是否有查询错误
-	if err = rows.Err(); err != nil {
-		return nil, err
+// quote 按源数据库的方言引用表名或字段名
+func (r *ReadLib) quote(name string) string {
+	return r.dialect.Quote(name)
+}
+
+// buildQuery 根据配置生成查询语句, condition 为筛选条件
+func (f *ReadLib) buildQuery(condition string) (string, error) {
+	source := f.Setting.Read.Source
+	if source.Query != "" {
+		if !strings.Contains(source.Query, "{condition}") {
+			return "", errors.New("read.source.query must contain the {condition} placeholder")
+		}
+		return strings.Replace(source.Query, "{condition}", condition, 1), nil
 	}
 
-	return records, nil
+	columns := "*"
+	if len(source.Columns) > 0 {
+		quoted := make([]string, len(source.Columns))
+		for i, column := range source.Columns {
+			quoted[i] = f.quote(column)
+		}
+		columns = strings.Join(quoted, ", ")
+	}
+	return `SELECT ` + columns + ` FROM ` + f.quote(source.Table) + ` WHERE ` + condition, nil
 }
 
 // ensureTableExists 确保 records 存在
@@ -201,14 +414,17 @@ func (r *ReadLib) ensureTableExists() error {
 		log.Fatal(err)
 	}
 
-	return err
+	// 多任务时按任务名区分本地记录, 旧版本的记录属于未命名的任务
+	return dao.AddColumnIfMissing(r.SqlLite, "records", "job", "TEXT DEFAULT ''")
 }
 
-// 获取MySql Read中最后一条id
+// 获取源表中最后一条id
 func (r *ReadLib) getLastId() (int64, error) {
 	var id int64
-	query := `SELECT id FROM book_user_feedback order by id desc limit 1`
-	err := r.Database.QueryRow(query).Scan(&id)
+	source := r.Setting.Read.Source
+	idColumn := r.quote(source.IdColumn)
+	query := `SELECT ` + idColumn + ` FROM ` + r.quote(source.Table) + ` order by ` + idColumn + ` desc ` + r.dialect.Limit()
+	err := r.Database.QueryRow(dao.Rebind(r.dialect, query), 1).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
@@ -217,8 +433,8 @@ func (r *ReadLib) getLastId() (int64, error) {
 
 func (r *ReadLib) getLocalLastId() (int64, error) {
 	var feed_id int64
-	query := `SELECT feed_id FROM records where flag = 0 order by id desc limit 1`
-	err := r.SqlLite.QueryRow(query).Scan(&feed_id)
+	query := `SELECT feed_id FROM records where job = ? and flag = 0 order by id desc limit 1`
+	err := r.SqlLite.QueryRow(query, r.Setting.Job).Scan(&feed_id)
 	if err != nil {
 		return 0, err
 	}
@@ -227,62 +443,58 @@ func (r *ReadLib) getLocalLastId() (int64, error) {
 
 // 更新本地结果
 func (r *ReadLib) UploadLocalRecord() error {
+	if r.fileMode() {
+		return r.saveFileProgress()
+	}
+	if r.timestampMode() {
+		return r.saveTimestampCursor()
+	}
 	if r.Begin == r.End {
-		log.Fatal("no record get update")
+		log.Println("no record get update")
 		return nil
 	}
+	return r.AdvanceTo(r.End)
+}
 
-	// 开启事务
-	tx, err := r.SqlLite.Begin()
-	if err != nil {
-		log.Fatal(err)
-		return err
+// AdvanceTo 将本地记录推进到 id, 整页数据写入飞书成功后调用
+func (r *ReadLib) AdvanceTo(id int64) error {
+	if id <= r.Begin {
+		return nil
 	}
 
-	// 更新 开始记录
-	begin, err := tx.Prepare("UPDATE records SET flag = ? WHERE feed_id = ?")
+	// 开启事务
+	tx, err := r.SqlLite.Begin()
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
 		return err
 	}
-	defer begin.Close()
-
-	// 执行更新操作
-	_, err = begin.Exec(1, r.Begin)
-	if err != nil {
+	if err := r.advanceTx(tx, id); err != nil {
 		// 如果有错误，回滚事务
 		tx.Rollback()
-		log.Fatal(err)
+		log.Println(err)
 		return err
 	}
 
-	end, err := tx.Prepare("INSERT INTO records(feed_id, flag, created_at) VALUES(?, ?, ?)")
+	// 提交事务
+	err = tx.Commit()
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
 		return err
 	}
-	defer end.Close()
-
-	// 获取当前时间
-	currentTime := time.Now()
-
-	// 格式化为 SQLite 支持的格式（ISO 8601 格式）
-	formattedDateTime := currentTime.Format("2006-01-02 15:04:05")
+	r.Begin = id
+	return nil
+}
 
-	// 执行更新操作
-	_, err = end.Exec(r.End, 0, formattedDateTime)
+// advanceTx 在调用方的事务中将本地记录从 r.Begin 推进到 id, 提交后由调用方更新 r.Begin
+func (r *ReadLib) advanceTx(tx *sql.Tx, id int64) error {
+	// 更新 开始记录
+	_, err := tx.Exec("UPDATE records SET flag = ? WHERE job = ? AND feed_id = ?", 1, r.Setting.Job, r.Begin)
 	if err != nil {
-		// 如果有错误，回滚事务
-		tx.Rollback()
-		log.Fatal(err)
 		return err
 	}
 
-	// 提交事务
-	err = tx.Commit()
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-	return nil
+	// 格式化为 SQLite 支持的格式（ISO 8601 格式）
+	formattedDateTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err = tx.Exec("INSERT INTO records(job, feed_id, flag, created_at) VALUES(?, ?, ?, ?)", r.Setting.Job, id, 0, formattedDateTime)
+	return err
 }
@@ -0,0 +1,115 @@
+package read
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"ser163.cn/earthworm/dao"
+	"strconv"
+	"time"
+)
+
+// Watermark 描述当前的同步进度
+func (r *ReadLib) Watermark() (string, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return "", err
+	}
+
+	switch {
+	case r.fileMode():
+		progress, err := r.loadFileProgress()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("file row %d (offset %d)", progress.Row, progress.Offset), nil
+	case r.timestampMode():
+		cursor, err := r.loadTimestampCursor()
+		if err != nil || cursor == nil {
+			return "timestamp none", err
+		}
+		return fmt.Sprintf("timestamp %s id %s", cursor.Timestamp, cursor.Id), nil
+	default:
+		id, err := r.getLocalLastId()
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		return "id " + strconv.FormatInt(id, 10), nil
+	}
+}
+
+// Pending 统计同步进度之后尚未读取的源数据条数, 文件数据源无法预先统计, 第二个返回值为 false
+func (r *ReadLib) Pending() (int64, bool, error) {
+	if r.fileMode() {
+		return 0, false, nil
+	}
+	if err := r.ensureTableExists(); err != nil {
+		return 0, false, err
+	}
+
+	var condition string
+	var args []interface{}
+	if r.timestampMode() {
+		cursor, err := r.loadTimestampCursor()
+		if err != nil {
+			return 0, false, err
+		}
+		condition, args = r.timestampCondition(cursor)
+	} else {
+		id, err := r.getLocalLastId()
+		if err != nil && err != sql.ErrNoRows {
+			return 0, false, err
+		}
+		condition, args = r.quote(r.Setting.Read.Source.IdColumn)+` > ?`, []interface{}{id}
+	}
+
+	query, err := r.buildQuery(condition)
+	if err != nil {
+		return 0, false, err
+	}
+	var count int64
+	err = r.Database.QueryRow(dao.Rebind(r.dialect, `SELECT COUNT(*) FROM (`+query+`) pending`), args...).Scan(&count)
+	if err != nil {
+		return 0, false, err
+	}
+	return count, true, nil
+}
+
+// Reset 将自增主键模式的本地记录回退或推进到 id, 返回原来的本地记录.
+// 之后从 id 之后的数据开始同步, 对应关系中已存在的数据按内容更新, 不会重复新建
+func (r *ReadLib) Reset(id int64) (int64, error) {
+	if r.fileMode() || r.timestampMode() {
+		return 0, errors.New("reset is only supported in id watermark mode")
+	}
+	if id < 0 {
+		return 0, fmt.Errorf("invalid id %d", id)
+	}
+	if err := r.ensureTableExists(); err != nil {
+		return 0, err
+	}
+	previous, err := r.getLocalLastId()
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	// 在同一个事务中结束当前的本地记录并写入新的本地记录
+	tx, err := r.SqlLite.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE records SET flag = 1 WHERE job = ? AND flag = 0`, r.Setting.Job); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO records(job, feed_id, flag, created_at) VALUES(?, ?, ?, ?)`,
+		r.Setting.Job, id, 0, time.Now().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	r.Begin = id
+	r.End = id
+	return previous, nil
+}
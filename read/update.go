@@ -0,0 +1,259 @@
+package read
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	"ser163.cn/earthworm/dao"
+	"ser163.cn/earthworm/utils"
+	"strings"
+	"time"
+)
+
+// BeginUpdates 从保存的进度开始查找更新, 之后逐页调用 Updates
+func (r *ReadLib) BeginUpdates() error {
+	value, err := dao.GetState(r.SqlLite, r.updateCursorKey())
+	if err != nil {
+		return err
+	}
+	r.updateCursor = nil
+	if strings.HasPrefix(value, "{") {
+		var cursor timestampCursor
+		if err := json.Unmarshal([]byte(value), &cursor); err != nil {
+			return fmt.Errorf("invalid update cursor %q: %v", value, err)
+		}
+		r.updateCursor = &cursor
+	} else if value != "" {
+		// 旧版本只保存了时间
+		r.updateCursor = &timestampCursor{Timestamp: value}
+	}
+	r.updateAfter = nil
+	r.updateDone = false
+	return nil
+}
+
+// Updates 查找下一页(至多 Mode.Rows 条)已同步但内容发生变化的源数据, 返回待更新的飞书记录和更新后的对应关系, 两者一一对应.
+// 配置了 sync.update.column 时只检查更新时间不早于上次进度的数据, 否则比较全部已同步数据的内容哈希.
+// 没有更多数据时 UpdatesDone 返回 true
+func (r *ReadLib) Updates() ([]*larkbitable.AppTableRecord, []dao.LedgerEntry, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, nil, err
+	}
+	if err := dao.EnsureLedgerTable(r.SqlLite); err != nil {
+		return nil, nil, err
+	}
+
+	var records []map[string]interface{}
+	var err error
+	if column := r.Setting.Sync.Update.Column; column != "" {
+		records, err = r.fetchUpdatedPage(column)
+	} else {
+		records, err = r.fetchSyncedPage()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.diffLedger(records, false)
+}
+
+// UpdatesDone 最近一次 Updates 是否没有读到数据
+func (r *ReadLib) UpdatesDone() bool {
+	return r.updateDone
+}
+
+// SaveUpdateCursor 保存本次查找更新的进度, 在所有更新写入飞书后调用
+func (r *ReadLib) SaveUpdateCursor() error {
+	if r.updateCursor == nil {
+		return nil
+	}
+	value, err := json.Marshal(r.updateCursor)
+	if err != nil {
+		return err
+	}
+	return dao.SetState(r.SqlLite, r.updateCursorKey(), string(value))
+}
+
+// Resync 将飞书的修改写回源数据库后调用, 按源数据的当前内容生成飞书记录的更新和对应关系, 两者一一对应.
+// 内容哈希没有变化的数据也会更新, 用于覆盖冲突时保留源表一边的字段
+func (r *ReadLib) Resync(ids []string) ([]*larkbitable.AppTableRecord, []dao.LedgerEntry, error) {
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+	records, err := r.fetchRecords(ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.diffLedger(records, true)
+}
+
+// updateCursorKey 更新进度在 state 表中的键
+func (r *ReadLib) updateCursorKey() string {
+	return r.Setting.StateKey("update:" + r.Setting.Read.Source.Table)
+}
+
+// fetchUpdatedPage 按 (更新时间, 主键) 顺序读取更新时间不早于上次进度且已经同步过的下一页源数据
+func (r *ReadLib) fetchUpdatedPage(column string) ([]map[string]interface{}, error) {
+	if r.updateDone {
+		return nil, nil
+	}
+
+	// 使用 >= 避免遗漏与上次进度同一时刻修改的数据, 内容未变化的数据会在比较哈希时跳过
+	quoted := r.quote(column)
+	idColumn := r.quote(r.Setting.Read.Source.IdColumn)
+	condition := quoted + ` IS NOT NULL`
+	var args []interface{}
+	if after := r.updateAfter; after != nil {
+		condition = `(` + quoted + ` > ? OR (` + quoted + ` = ? AND ` + idColumn + ` > ?))`
+		value := cursorArg(after)
+		args = append(args, value, value, after.Id)
+	} else if r.updateCursor != nil {
+		condition = quoted + ` >= ?`
+		args = append(args, cursorArg(r.updateCursor))
+	}
+
+	// 自增主键模式下排除尚未新建的数据
+	if !r.timestampMode() {
+		localLastId, err := r.getLocalLastId()
+		if err == sql.ErrNoRows {
+			r.updateDone = true
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		condition += ` AND ` + idColumn + ` <= ?`
+		args = append(args, localLastId)
+	}
+
+	query, err := r.buildQuery(condition)
+	if err != nil {
+		return nil, err
+	}
+	query += ` ORDER BY ` + quoted + `, ` + idColumn + ` ` + r.dialect.Limit()
+	args = append(args, r.Setting.Read.Mode.Rows)
+
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records, raws, err := dao.ScanSourceRows(rows, column)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		r.updateDone = true
+		return nil, nil
+	}
+
+	// 按更新时间排序, 最后一条数据的更新时间即为读到的最大更新时间
+	id, err := r.sourceId(records[len(records)-1])
+	if err != nil {
+		return nil, err
+	}
+	r.updateAfter, err = r.newCursor(column, raws[len(raws)-1], id)
+	if err != nil {
+		return nil, err
+	}
+	r.updateCursor = &timestampCursor{Timestamp: r.updateAfter.Timestamp, Text: r.updateAfter.Text}
+	return records, nil
+}
+
+// fetchSyncedPage 按对应关系读取下一页已同步的源数据
+func (r *ReadLib) fetchSyncedPage() ([]map[string]interface{}, error) {
+	if r.updateDone {
+		return nil, nil
+	}
+
+	afterId := ""
+	if r.updateAfter != nil {
+		afterId = r.updateAfter.Id
+	}
+	entries, err := dao.ListLedgerEntries(r.SqlLite, r.Setting.LedgerTable(), afterId, int(r.Setting.Read.Mode.Rows))
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		r.updateDone = true
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.SourceId)
+	}
+	r.updateAfter = &timestampCursor{Id: entries[len(entries)-1].SourceId}
+	return r.fetchRecords(ids)
+}
+
+// diffLedger 比较源数据与对应关系中的内容哈希, 返回内容发生变化的记录, force 为 true 时返回全部有对应关系的记录
+func (r *ReadLib) diffLedger(records []map[string]interface{}, force bool) ([]*larkbitable.AppTableRecord, []dao.LedgerEntry, error) {
+	mapper, err := r.getMapper()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tableRecords []*larkbitable.AppTableRecord
+	var entries []dao.LedgerEntry
+	for _, record := range records {
+		id, err := r.sourceId(record)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		entry, err := dao.GetLedgerEntry(r.SqlLite, r.Setting.LedgerTable(), id)
+		if err == sql.ErrNoRows {
+			// 没有对应的飞书记录, 无法更新
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := dao.RowError(record); err != nil {
+			if err := r.deadLetter(dao.StageFetch, id, record, err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		args, err := mapper.Map(record)
+		if err != nil {
+			if err := r.deadLetter(dao.StageConvert, id, record, err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		hash, err := utils.ContentHash(args)
+		if err != nil {
+			return nil, nil, fmt.Errorf("record %s: %v", id, err)
+		}
+		if hash == entry.ContentHash && !force {
+			continue
+		}
+
+		update, err := r.ledgerUpdate(id, record, args, hash, entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		tableRecords = append(tableRecords, update)
+		entries = append(entries, *entry)
+	}
+	return tableRecords, entries, nil
+}
+
+// ledgerUpdate 生成已同步数据的飞书记录更新, 并将 entry 更新为写入后的对应关系
+func (r *ReadLib) ledgerUpdate(id string, record map[string]interface{}, args map[string]interface{}, hash string, entry *dao.LedgerEntry) (*larkbitable.AppTableRecord, error) {
+	open, err := r.openConflicts(id, entry.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	recordId := entry.RecordId
+	update := &larkbitable.AppTableRecord{RecordId: &recordId, Fields: r.pushFields(args, open)}
+	entry.ContentHash = hash
+	entry.SyncedAt = time.Now()
+	entry.Snapshot = r.snapshot(record, entry.Snapshot, open)
+	return update, nil
+}
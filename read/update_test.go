@@ -0,0 +1,71 @@
+package read
+
+import (
+	"ser163.cn/earthworm/dao"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// collectUpdates 从头逐页查找更新, 返回全部更新对应的源数据ID
+func collectUpdates(t *testing.T, r *ReadLib) []string {
+	t.Helper()
+	if err := r.BeginUpdates(); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for page := 0; ; page++ {
+		if page > 10 {
+			t.Fatalf("updates did not finish, read %v", ids)
+		}
+		_, entries, err := r.Updates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.UpdatesDone() {
+			return ids
+		}
+		for _, entry := range entries {
+			ids = append(ids, entry.SourceId)
+		}
+	}
+}
+
+func TestUpdatesPaged(t *testing.T) {
+	state, source := openTestDatabases(t)
+	if _, err := source.Exec(`CREATE TABLE feedback (id INTEGER PRIMARY KEY, updated_at DATETIME)`); err != nil {
+		t.Fatal(err)
+	}
+	// 四条数据的更新时间相同, 按主键区分分页位置
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	var entries []dao.LedgerEntry
+	for id := 1; id <= 4; id++ {
+		if _, err := source.Exec(`INSERT INTO feedback (id, updated_at) VALUES (?, ?)`, id, base); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, dao.LedgerEntry{SourceTable: "feedback", SourceId: strconv.Itoa(id), RecordId: "rec", ContentHash: "stale"})
+	}
+
+	conf := testConfig("feedback")
+	conf.Read.Source.Watermark.Mode = "timestamp"
+	conf.Read.Source.Watermark.Column = "updated_at"
+	r := NewReadLib(conf, source, state)
+	if err := dao.EnsureLedgerTable(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := dao.SaveLedgerEntries(state, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, column := range []string{"", "updated_at"} {
+		conf.Sync.Update.Column = column
+		ids := collectUpdates(t, r)
+		if len(ids) != 4 {
+			t.Fatalf("column %q: updates %v, want all 4 records", column, ids)
+		}
+	}
+	// SQLite 中保存驱动写入的原文
+	if want := "2024-05-01 10:00:00+00:00"; r.updateCursor == nil || r.updateCursor.Timestamp != want {
+		t.Errorf("update cursor %+v, want %s", r.updateCursor, want)
+	}
+}
@@ -0,0 +1,146 @@
+package read
+
+import (
+	"encoding/json"
+	"fmt"
+	"ser163.cn/earthworm/dao"
+	"time"
+)
+
+// timestampCursor 时间戳模式下的同步进度, 时间相同时按主键区分先后.
+// 驱动返回时间类型时 Timestamp 以 RFC3339Nano 保存完整的精度和时区, 否则保存数据库中的原文, Text 为 true
+type timestampCursor struct {
+	Timestamp string `json:"timestamp"`
+	Id        string `json:"id,omitempty"`
+	Text      bool   `json:"text,omitempty"`
+}
+
+// newCursor 按时间字段 column 的原始值生成 id 这条数据的进度.
+// 时间以文本保存的数据库(SQLite)中驱动返回的时间无法还原原文, 重新读取保存的文本
+func (r *ReadLib) newCursor(column string, raw interface{}, id string) (*timestampCursor, error) {
+	t, ok := raw.(time.Time)
+	if !ok {
+		return &timestampCursor{Timestamp: fmt.Sprint(raw), Id: id, Text: true}, nil
+	}
+	if !r.dialect.TextTime() {
+		return &timestampCursor{Timestamp: t.Format(time.RFC3339Nano), Id: id}, nil
+	}
+
+	query := `SELECT CAST(` + r.quote(column) + ` AS TEXT) FROM ` + r.quote(r.Setting.Read.Source.Table) +
+		` WHERE ` + r.quote(r.Setting.Read.Source.IdColumn) + ` = ?`
+	var text string
+	if err := r.Database.QueryRow(dao.Rebind(r.dialect, query), id).Scan(&text); err != nil {
+		return nil, fmt.Errorf("reading %s of %s: %v", column, id, err)
+	}
+	return &timestampCursor{Timestamp: text, Id: id, Text: true}, nil
+}
+
+// cursorArg 查询时绑定的进度值. 原文按字符串绑定, 与数据库中保存的值按相同方式比较;
+// 时间类型的进度按 time.Time 绑定, 避免按字符串比较时丢失精度
+func cursorArg(cursor *timestampCursor) interface{} {
+	if cursor.Text {
+		return cursor.Timestamp
+	}
+	if t, err := time.Parse(time.RFC3339Nano, cursor.Timestamp); err == nil {
+		return t
+	}
+	return cursor.Timestamp
+}
+
+// timestampMode 是否按时间字段同步
+func (r *ReadLib) timestampMode() bool {
+	return r.Setting.Read.Source.Watermark.Mode == "timestamp"
+}
+
+// watermarkKey 时间戳进度在 state 表中的键
+func (r *ReadLib) watermarkKey() string {
+	return r.Setting.StateKey("watermark:" + r.Setting.Read.Source.Table)
+}
+
+// loadTimestampCursor 读取时间戳进度, 从未同步时返回 nil
+func (r *ReadLib) loadTimestampCursor() (*timestampCursor, error) {
+	value, err := dao.GetState(r.SqlLite, r.watermarkKey())
+	if err != nil || value == "" {
+		return nil, err
+	}
+
+	var cursor timestampCursor
+	if err := json.Unmarshal([]byte(value), &cursor); err != nil {
+		return nil, fmt.Errorf("invalid watermark %q: %v", value, err)
+	}
+	return &cursor, nil
+}
+
+// saveTimestampCursor 将时间戳进度推进到本页最后一条数据
+func (r *ReadLib) saveTimestampCursor() error {
+	if r.pageCursor == nil {
+		return nil
+	}
+	value, err := json.Marshal(r.pageCursor)
+	if err != nil {
+		return err
+	}
+	if err := dao.SetState(r.SqlLite, r.watermarkKey(), string(value)); err != nil {
+		return err
+	}
+	r.pageCursor = nil
+	return nil
+}
+
+// timestampCondition 时间戳进度之后的数据的筛选条件, cursor 为 nil 时为全部时间字段不为 NULL 的数据
+func (r *ReadLib) timestampCondition(cursor *timestampCursor) (string, []interface{}) {
+	column := r.quote(r.Setting.Read.Source.Watermark.Column)
+	if cursor == nil {
+		return column + ` IS NOT NULL`, nil
+	}
+	idColumn := r.quote(r.Setting.Read.Source.IdColumn)
+	condition := `(` + column + ` > ? OR (` + column + ` = ? AND ` + idColumn + ` > ?))`
+	timestamp := cursorArg(cursor)
+	return condition, []interface{}{timestamp, timestamp, cursor.Id}
+}
+
+// fetchTimestampPage 按 (时间字段, 主键) 顺序读取进度之后的一页数据, 时间字段为 NULL 的数据不会被读取
+func (r *ReadLib) fetchTimestampPage() ([]map[string]interface{}, error) {
+	cursor, err := r.loadTimestampCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	column := r.Setting.Read.Source.Watermark.Column
+	condition, args := r.timestampCondition(cursor)
+	query, err := r.buildQuery(condition)
+	if err != nil {
+		return nil, err
+	}
+	query += ` ORDER BY ` + r.quote(column) + `, ` + r.quote(r.Setting.Read.Source.IdColumn) + ` ` + r.dialect.Limit()
+	args = append(args, r.Setting.Read.Mode.Rows)
+
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records, raws, err := dao.ScanSourceRows(rows, column)
+	if err != nil {
+		return nil, err
+	}
+
+	r.pageCursor = nil
+	if len(records) > 0 {
+		last := records[len(records)-1]
+		id, err := r.sourceId(last)
+		if err != nil {
+			return nil, err
+		}
+		r.pageCursor, err = r.newCursor(column, raws[len(raws)-1], id)
+		if err != nil {
+			return nil, err
+		}
+		// 进度没有前进时继续读取会得到同一页, 同步不会结束
+		if cursor != nil && *r.pageCursor == *cursor {
+			return nil, fmt.Errorf("watermark did not advance past %s %s, check the type of column %s", cursor.Timestamp, cursor.Id, column)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,138 @@
+package read
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"ser163.cn/earthworm/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDatabases 在临时目录中创建本地数据库和 SQLite 源数据库
+func openTestDatabases(t *testing.T) (*sql.DB, *sql.DB) {
+	t.Helper()
+	dir := t.TempDir()
+	state, err := sql.Open("sqlite3", filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := sql.Open("sqlite3", filepath.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		state.Close()
+		source.Close()
+	})
+	return state, source
+}
+
+// testConfig 读取 SQLite 源表 table 的任务配置
+func testConfig(table string) *config.Config {
+	conf := &config.Config{}
+	conf.Read.Driver = "sqlite3"
+	conf.Read.Source.Table = table
+	conf.Read.Source.IdColumn = "id"
+	conf.Read.Mode.Rows = 1
+	conf.Mapping = []config.Field{{Field: "编号", Column: "id", Type: "number"}}
+	return conf
+}
+
+func TestTimestampWatermarkSubSecond(t *testing.T) {
+	state, source := openTestDatabases(t)
+	if _, err := source.Exec(`CREATE TABLE feedback (id INTEGER PRIMARY KEY, updated_at DATETIME)`); err != nil {
+		t.Fatal(err)
+	}
+	// 三条数据在同一秒内, 按秒截断后时间相同
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i, offset := range []time.Duration{100, 200, 300} {
+		_, err := source.Exec(`INSERT INTO feedback (id, updated_at) VALUES (?, ?)`, 3-i, base.Add(offset*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := testConfig("feedback")
+	conf.Read.Source.Watermark.Mode = "timestamp"
+	conf.Read.Source.Watermark.Column = "updated_at"
+	r := NewReadLib(conf, source, state)
+
+	var ids []string
+	for page := 0; ; page++ {
+		if page > 5 {
+			t.Fatalf("transfer did not finish, read %v", ids)
+		}
+		if _, err := r.Transfer(); err != nil {
+			t.Fatal(err)
+		}
+		if r.Done() {
+			break
+		}
+		ids = append(ids, r.Ids...)
+		if err := r.UploadLocalRecord(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"3", "2", "1"}
+	if len(ids) != len(want) {
+		t.Fatalf("read %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("read %v, want %v", ids, want)
+		}
+	}
+
+	cursor, err := r.loadTimestampCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.Timestamp != "2024-05-01 10:00:00.3+00:00" {
+		t.Errorf("watermark %s lost precision", cursor.Timestamp)
+	}
+}
+
+func TestTimestampWatermarkText(t *testing.T) {
+	for _, columnType := range []string{"TEXT", "DATETIME"} {
+		t.Run(columnType, func(t *testing.T) {
+			state, source := openTestDatabases(t)
+			if _, err := source.Exec(`CREATE TABLE feedback (id INTEGER PRIMARY KEY, updated_at ` + columnType + `)`); err != nil {
+				t.Fatal(err)
+			}
+			// 通过 SQL 写入的时间没有时区, 前两条时间相同, 只能按主键区分先后
+			_, err := source.Exec(`INSERT INTO feedback (id, updated_at) VALUES
+				(1, '2024-05-01 10:00:00'), (2, '2024-05-01 10:00:00'), (3, '2024-05-01 10:00:01'), (4, '2024-05-01T10:00:02Z')`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conf := testConfig("feedback")
+			conf.Read.Source.Watermark.Mode = "timestamp"
+			conf.Read.Source.Watermark.Column = "updated_at"
+			r := NewReadLib(conf, source, state)
+
+			var ids []string
+			for page := 0; ; page++ {
+				if page > 5 {
+					t.Fatalf("transfer did not finish, read %v", ids)
+				}
+				if _, err := r.Transfer(); err != nil {
+					t.Fatal(err)
+				}
+				if r.Done() {
+					break
+				}
+				ids = append(ids, r.Ids...)
+				if err := r.UploadLocalRecord(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := strings.Join(ids, ","); got != "1,2,3,4" {
+				t.Errorf("read %s, want 1,2,3,4", got)
+			}
+		})
+	}
+}
@@ -1,8 +1,13 @@
 package utils
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -24,15 +29,6 @@ func GetNowUnixMilli() *int64 {
 	return &now
 }
 
-// GenerateIDList 生成指定范围内的ID列表
-func GenerateIDList(start, end int64) []int64 {
-	var ids []int64
-	for i := start + 1; i <= end; i++ { // 从 start+1 开始生成
-		ids = append(ids, i)
-	}
-	return ids
-}
-
 // 判断文件是否存在
 
 func FileExists(filename string) bool {
@@ -43,6 +39,16 @@ func FileExists(filename string) bool {
 	return true
 }
 
+// Contains 判断字符串列表中是否包含 value
+func Contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
 // 辅助函数: 生成 SQL 查询占位符
 func BuildPlaceholders(n int) string {
 	placeholders := make([]string, n)
@@ -67,3 +73,47 @@ func TimeStrToUnixMilli(timeStr string) (int64, error) {
 	// 转换为 Unix 时间戳
 	return t.UnixMilli(), nil
 }
+
+// DeterministicUUID 根据输入生成固定的 UUID v4 格式字符串, 相同输入总是得到相同结果
+func DeterministicUUID(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	uuid := sum[:16]
+	uuid[6] = (uuid[6] & 0x0f) | 0x40 // version 4
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // variant RFC 4122
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// ContentHash 计算字段内容的哈希, map 的键按字母顺序序列化, 结果与字段顺序无关
+func ContentHash(fields map[string]interface{}) (string, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// SameValue 比较两个字段值, 数字按数值比较, 布尔值与 0、1 相等
+func SameValue(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return ValueString(a) == ValueString(b)
+}
+
+// ValueString 将字段值转换为用于比较和保存的字符串
+func ValueString(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float64:
+		if v == math.Trunc(v) {
+			return strconv.FormatFloat(v, 'f', 0, 64)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
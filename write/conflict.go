@@ -0,0 +1,161 @@
+package write
+
+import (
+	"fmt"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	"log"
+	"ser163.cn/earthworm/config"
+	"ser163.cn/earthworm/dao"
+	"ser163.cn/earthworm/mapping"
+	"ser163.cn/earthworm/utils"
+)
+
+// pulledRecord 一条待写回的多维表格记录
+type pulledRecord struct {
+	record *larkbitable.AppTableRecord
+	entry  *dao.LedgerEntry
+	values map[string]interface{} // 转换为源字段后的值, 以源字段名为键
+
+	conflicts []dao.Conflict // 两边都修改过的字段, 写回提交后保存
+	agreed    []string       // 两边已经一致的冲突字段, 写回提交后标记
+}
+
+// resolve 逐个字段比较源表的当前值 row 与多维表格中的值, 返回需要写入源表的字段和值,
+// 以及是否需要将源数据重新同步到飞书
+func (w *WriteLib) resolve(pulled *pulledRecord, row map[string]interface{}) ([]string, []interface{}, bool, error) {
+	open, err := dao.OpenConflictFields(w.SqlLite, pulled.entry.SourceTable, pulled.entry.SourceId)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	isOpen := make(map[string]bool, len(open))
+	for _, field := range open {
+		isOpen[field] = true
+	}
+
+	var sets []string
+	var args []interface{}
+	resync := false
+	for _, field := range w.mapper.Fields {
+		source, bitable := row[field.Column], pulled.values[field.Column]
+		if utils.SameValue(source, bitable) {
+			if isOpen[field.Field] {
+				pulled.agreed = append(pulled.agreed, field.Field)
+			}
+			continue
+		}
+
+		winner, err := w.winner(field, pulled, row)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		switch winner {
+		case config.ConflictBitable:
+			sets = append(sets, w.dialect.Quote(field.Column)+` = ?`)
+			args = append(args, bitable)
+			resync = true
+		case config.ConflictSource:
+			resync = true
+		}
+	}
+	return sets, args, resync, nil
+}
+
+// winner 两边的值不一致时, 按快照判断字段在哪一边被修改过, 返回保留的一边: source、bitable,
+// 为空表示待人工处理. 两边都修改过时记录到 pulled.conflicts, 由 saveConflicts 保存
+func (w *WriteLib) winner(field config.Field, pulled *pulledRecord, row map[string]interface{}) (string, error) {
+	source, bitable := row[field.Column], pulled.values[field.Column]
+
+	// 快照中没有该字段时无法判断源表是否修改过, 按只有多维表格修改处理
+	base, known := pulled.entry.Snapshot[field.Column]
+	var baseValue interface{}
+	if base != nil {
+		baseValue = *base
+	}
+	sourceChanged := known && !utils.SameValue(source, baseValue)
+	bitableChanged := !known || !utils.SameValue(bitable, baseValue)
+
+	policy := w.Setting.ConflictPolicy(field.Field)
+	var winner string
+	switch {
+	case policy == config.ConflictSource || policy == config.ConflictBitable:
+		winner = policy
+	case !sourceChanged:
+		winner = config.ConflictBitable
+	case !bitableChanged:
+		winner = config.ConflictSource
+	case policy == config.ConflictLWW:
+		bitableWins, err := w.bitableIsNewer(pulled.record, row)
+		if err != nil {
+			return "", err
+		}
+		winner = config.ConflictSource
+		if bitableWins {
+			winner = config.ConflictBitable
+		}
+	}
+	if !sourceChanged || !bitableChanged {
+		return winner, nil
+	}
+
+	log.Printf("conflict on %s of %s %s, policy %s, keep %q", field.Field, pulled.entry.SourceTable, pulled.entry.SourceId, policy, winner)
+	pulled.conflicts = append(pulled.conflicts, dao.Conflict{
+		SourceTable: pulled.entry.SourceTable,
+		SourceId:    pulled.entry.SourceId,
+		RecordId:    pulled.entry.RecordId,
+		Field:       field.Field,
+		Column:      field.Column,
+		Base:        base,
+		Source:      valuePointer(source),
+		Bitable:     valuePointer(bitable),
+		Policy:      policy,
+		Resolution:  winner,
+	})
+	return winner, nil
+}
+
+// saveConflicts 源表的修改提交后, 保存两边都修改过的字段, 并标记两边已经一致的冲突
+func (w *WriteLib) saveConflicts(pulled *pulledRecord) error {
+	for _, conflict := range pulled.conflicts {
+		if err := dao.SaveConflict(w.SqlLite, conflict); err != nil {
+			return err
+		}
+	}
+	for _, field := range pulled.agreed {
+		if err := dao.ResolveConflict(w.SqlLite, pulled.entry.SourceTable, pulled.entry.SourceId, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bitableIsNewer 比较飞书记录的修改时间与源表的修改时间字段, 源表没有修改时间时以飞书为准.
+// 修改时间按日期字段转换, 字符串按 sync.conflict 的 layout 和 timezone 解析
+func (w *WriteLib) bitableIsNewer(record *larkbitable.AppTableRecord, row map[string]interface{}) (bool, error) {
+	conflict := w.Setting.Sync.Conflict
+	if record.LastModifiedTime == nil {
+		return false, nil
+	}
+
+	convert, err := mapping.GetConverter(mapping.TypeDate)
+	if err != nil {
+		return false, err
+	}
+	field := config.Field{Column: conflict.Column, Type: mapping.TypeDate, Layout: conflict.Layout, Timezone: conflict.Timezone}
+	modified, err := convert(field, row[conflict.Column])
+	if err != nil {
+		return false, fmt.Errorf("column %s: %v", conflict.Column, err)
+	}
+	if modified == nil {
+		return true, nil
+	}
+	return *record.LastModifiedTime > modified.(int64), nil
+}
+
+// valuePointer 将字段值转换为保存到 conflicts 表的字符串, 空值为 nil
+func valuePointer(value interface{}) *string {
+	if value == nil {
+		return nil
+	}
+	s := utils.ValueString(value)
+	return &s
+}
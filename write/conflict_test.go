@@ -0,0 +1,138 @@
+package write
+
+import (
+	"database/sql"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"ser163.cn/earthworm/config"
+	"ser163.cn/earthworm/dao"
+	"testing"
+	"time"
+)
+
+// testConfig 将多维表格的"状态"写回 SQLite 源表 feedback 的 status 字段, 冲突时按 policy 处理
+func testConfig(policy string) *config.Config {
+	conf := &config.Config{}
+	conf.Read.Driver = "sqlite3"
+	conf.Read.Source.Table = "feedback"
+	conf.Read.Source.IdColumn = "id"
+	conf.Sync.Pull.Fields = []config.Field{{Field: "状态", Column: "status"}}
+	conf.Sync.Conflict.Default = policy
+	conf.Sync.Conflict.Column = "updated_at"
+	return conf
+}
+
+func TestWinner(t *testing.T) {
+	// 上次同步后两边都是 open, 源表在 10:00 修改
+	base := "open"
+	modified := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	before, after := modified.Add(-time.Hour).UnixMilli(), modified.Add(time.Hour).UnixMilli()
+
+	tests := []struct {
+		name      string
+		policy    string
+		source    string
+		bitable   string
+		modified  int64 // 飞书记录的修改时间
+		want      string
+		conflicts int
+	}{
+		{"source", config.ConflictSource, "closed", "pending", after, config.ConflictSource, 1},
+		{"bitable", config.ConflictBitable, "closed", "pending", before, config.ConflictBitable, 1},
+		{"lww bitable newer", config.ConflictLWW, "closed", "pending", after, config.ConflictBitable, 1},
+		{"lww source newer", config.ConflictLWW, "closed", "pending", before, config.ConflictSource, 1},
+		{"manual", config.ConflictManual, "closed", "pending", after, "", 1},
+		// 只有一边修改过时不是冲突, 保留修改过的一边
+		{"manual bitable changed", config.ConflictManual, base, "pending", after, config.ConflictBitable, 0},
+		{"manual source changed", config.ConflictManual, "closed", base, after, config.ConflictSource, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWriteLib(testConfig(tt.policy), nil, nil)
+			field := w.Setting.Sync.Pull.Fields[0]
+			pulled := &pulledRecord{
+				record: &larkbitable.AppTableRecord{LastModifiedTime: &tt.modified},
+				entry:  &dao.LedgerEntry{SourceTable: "feedback", SourceId: "1", RecordId: "rec1", Snapshot: dao.Snapshot{"status": &base}},
+				values: map[string]interface{}{"status": tt.bitable},
+			}
+			row := map[string]interface{}{"status": tt.source, "updated_at": modified.Format("2006-01-02 15:04:05")}
+
+			winner, err := w.winner(field, pulled, row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if winner != tt.want {
+				t.Errorf("winner %q, want %q", winner, tt.want)
+			}
+			if len(pulled.conflicts) != tt.conflicts {
+				t.Fatalf("%d conflicts, want %d", len(pulled.conflicts), tt.conflicts)
+			}
+			if tt.conflicts > 0 && pulled.conflicts[0].Resolution != tt.want {
+				t.Errorf("conflict resolved as %q, want %q", pulled.conflicts[0].Resolution, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyManualConflict(t *testing.T) {
+	dir := t.TempDir()
+	state, err := sql.Open("sqlite3", filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := sql.Open("sqlite3", filepath.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		state.Close()
+		source.Close()
+	})
+
+	// 上次同步后两边都是 open, 之后源表改为 closed, 多维表格改为 pending
+	if _, err := source.Exec(`CREATE TABLE feedback (id INTEGER PRIMARY KEY, status TEXT, updated_at TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Exec(`INSERT INTO feedback (id, status) VALUES (1, 'closed')`); err != nil {
+		t.Fatal(err)
+	}
+	conf := testConfig(config.ConflictManual)
+	if err := dao.EnsureLedgerTable(state); err != nil {
+		t.Fatal(err)
+	}
+	base := "open"
+	entry := dao.LedgerEntry{SourceTable: conf.LedgerTable(), SourceId: "1", RecordId: "rec1", Snapshot: dao.Snapshot{"status": &base}}
+	if err := dao.SaveLedgerEntries(state, []dao.LedgerEntry{entry}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWriteLib(conf, source, state)
+	recordId := "rec1"
+	changed, err := w.Apply([]*larkbitable.AppTableRecord{{RecordId: &recordId, Fields: map[string]interface{}{"状态": "pending"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("resync %v, want none", changed)
+	}
+
+	var status string
+	if err := source.QueryRow(`SELECT status FROM feedback WHERE id = 1`).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != "closed" {
+		t.Errorf("source status %q, want closed", status)
+	}
+
+	var field, sourceValue, bitableValue string
+	var resolution sql.NullString
+	err = state.QueryRow(`SELECT field, source_value, bitable_value, resolution FROM conflicts WHERE source_id = '1'`).
+		Scan(&field, &sourceValue, &bitableValue, &resolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if field != "状态" || sourceValue != "closed" || bitableValue != "pending" || resolution.Valid {
+		t.Errorf("conflict %s %s %s %v, want an open conflict on 状态 closed pending", field, sourceValue, bitableValue, resolution)
+	}
+}
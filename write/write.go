@@ -0,0 +1,241 @@
+package write
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	larkbitable "github.com/larksuite/oapi-sdk-go/v3/service/bitable/v1"
+	"log"
+	"ser163.cn/earthworm/config"
+	"ser163.cn/earthworm/dao"
+	"ser163.cn/earthworm/mapping"
+	"ser163.cn/earthworm/utils"
+	"strconv"
+	"strings"
+)
+
+// WriteLib 将多维表格中修改的字段写回源数据库
+type WriteLib struct {
+	Setting  *config.Config
+	Database *sql.DB
+	SqlLite  *sql.DB
+
+	mapper  *mapping.ReverseMapper
+	dialect dao.Dialect // 源数据库的 SQL 方言
+}
+
+// NewWriteLib 创建WriteLib实例, conf 为任务的配置
+func NewWriteLib(conf *config.Config, sourceDb *sql.DB, sqllite *sql.DB) *WriteLib {
+	return &WriteLib{
+		Setting:  conf,
+		Database: sourceDb,
+		SqlLite:  sqllite,
+		dialect:  dao.GetDialect(conf.Read.Driver),
+	}
+}
+
+// FieldNames 需要从多维表格读取的字段
+func (w *WriteLib) FieldNames() ([]string, error) {
+	mapper, err := w.getMapper()
+	if err != nil {
+		return nil, err
+	}
+	return mapper.FieldNames(), nil
+}
+
+// cursorKey 写回进度在 state 表中的键
+func (w *WriteLib) cursorKey() string {
+	return w.Setting.StateKey("pull:" + w.Setting.FeiShu.Drive.BaseId + ":" + w.Setting.FeiShu.Drive.TableId)
+}
+
+// LoadCursor 读取上次写回的进度, 即已处理记录的最晚修改时间(毫秒), 从未写回时为 0
+func (w *WriteLib) LoadCursor() (int64, error) {
+	value, err := dao.GetState(w.SqlLite, w.cursorKey())
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// SaveCursor 保存写回进度, 在本次读到的记录全部写回后调用
+func (w *WriteLib) SaveCursor(modified int64) error {
+	return dao.SetState(w.SqlLite, w.cursorKey(), strconv.FormatInt(modified, 10))
+}
+
+// Apply 将一页多维表格记录写回源表, 所有修改在同一个事务中提交.
+// 只处理 record_ledger 中存在对应关系的记录, 值没有变化的字段不会写入; 两边都修改过的字段按冲突策略处理.
+// 值无法转换的记录放入无法同步的数据中, 不影响其他记录.
+// 返回需要将源数据重新同步到飞书的主键: 写回过字段, 或者冲突时保留源表一边的记录
+func (w *WriteLib) Apply(records []*larkbitable.AppTableRecord) ([]string, error) {
+	mapper, err := w.getMapper()
+	if err != nil {
+		return nil, err
+	}
+	if err := dao.EnsureLedgerTable(w.SqlLite); err != nil {
+		return nil, err
+	}
+
+	table := w.Setting.Read.Source.Table
+	var ids []string
+	pulled := make(map[string]*pulledRecord)
+	for _, record := range records {
+		if record.RecordId == nil {
+			continue
+		}
+		entry, err := dao.GetLedgerEntryByRecordId(w.SqlLite, w.Setting.LedgerTable(), *record.RecordId)
+		if err == sql.ErrNoRows {
+			// 不是由本程序同步的记录
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Archived {
+			continue
+		}
+
+		values, err := mapper.Map(record.Fields)
+		if err != nil {
+			// 只跳过这一条记录, 同一页的其他记录继续写回
+			if err := w.deadLetter(entry, record, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, ok := pulled[entry.SourceId]; !ok {
+			ids = append(ids, entry.SourceId)
+		}
+		pulled[entry.SourceId] = &pulledRecord{record: record, entry: entry, values: values}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	current, err := w.currentValues(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := w.Database.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	written := 0
+	for _, id := range ids {
+		row, ok := current[id]
+		if !ok {
+			// 源数据已被删除
+			continue
+		}
+
+		sets, args, resync, err := w.resolve(pulled[id], row)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("record %s: %v", id, err)
+		}
+		if resync {
+			changed = append(changed, id)
+		}
+		if len(sets) == 0 {
+			continue
+		}
+
+		query := `UPDATE ` + w.dialect.Quote(table) + ` SET ` + strings.Join(sets, ", ") +
+			` WHERE ` + w.dialect.Quote(w.Setting.Read.Source.IdColumn) + ` = ?`
+		args = append(args, id)
+		if _, err := tx.Exec(dao.Rebind(w.dialect, query), args...); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("update %s %s: %v", table, id, err)
+		}
+		written++
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// 冲突在源表的修改提交后才保存, 提交失败时不会留下未写回的冲突
+	for _, id := range ids {
+		if _, ok := current[id]; !ok {
+			continue
+		}
+		if err := w.saveConflicts(pulled[id]); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("pulled %d records, %d written, %d to resync", len(ids), written, len(changed))
+	return changed, nil
+}
+
+// deadLetter 记录一条无法写回的飞书记录并跳过, 与无法同步的源数据保存在一起
+func (w *WriteLib) deadLetter(entry *dao.LedgerEntry, record *larkbitable.AppTableRecord, cause error) error {
+	row, err := json.Marshal(record.Fields)
+	if err != nil {
+		return err
+	}
+	log.Printf("skipping record %s of %s %s at %s: %v", *record.RecordId, entry.SourceTable, entry.SourceId, dao.StagePull, cause)
+	return dao.SaveDeadLetter(w.SqlLite, dao.DeadLetter{
+		Job:         w.Setting.Job,
+		SourceTable: w.Setting.Read.Source.Table,
+		SourceId:    entry.SourceId,
+		Stage:       dao.StagePull,
+		Row:         string(row),
+		Error:       cause.Error(),
+	})
+}
+
+// currentValues 查询源数据中需要写回的字段和 lww 策略比较的修改时间的当前值, 以主键为键
+func (w *WriteLib) currentValues(ids []string) (map[string]map[string]interface{}, error) {
+	idColumn := w.Setting.Read.Source.IdColumn
+	names := []string{idColumn}
+	for _, field := range w.mapper.Fields {
+		names = append(names, field.Column)
+	}
+	if column := w.Setting.Sync.Conflict.Column; column != "" {
+		names = append(names, column)
+	}
+
+	var columns []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			columns = append(columns, w.dialect.Quote(name))
+		}
+	}
+	query := `SELECT ` + strings.Join(columns, ", ") + ` FROM ` + w.dialect.Quote(w.Setting.Read.Source.Table) +
+		` WHERE ` + w.dialect.Quote(idColumn) + ` IN (` + utils.BuildPlaceholders(len(ids)) + `)`
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := w.Database.Query(dao.Rebind(w.dialect, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records, err := dao.ScanRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]map[string]interface{}, len(records))
+	for _, record := range records {
+		current[fmt.Sprint(record[idColumn])] = record
+	}
+	return current, nil
+}
+
+// getMapper 获取写回字段的映射, 只解析一次配置
+func (w *WriteLib) getMapper() (*mapping.ReverseMapper, error) {
+	if w.mapper == nil {
+		mapper, err := mapping.NewReverseMapper(w.Setting.Sync.Pull.Fields)
+		if err != nil {
+			return nil, err
+		}
+		w.mapper = mapper
+	}
+	return w.mapper, nil
+}